@@ -3,25 +3,29 @@
 package kubecerthttp
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
-	"errors"
+	"encoding/pem"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
-	"sync"
 	"time"
 )
 
 const (
 	// secretsEndpoint is the path to fetch kubernetes secrets
-	secretsWatchEndpoint = "%s/api/v1/namespaces/%s/secrets?watch=true&resourceVersion=%s"
+	secretsWatchEndpoint = "%s/api/v1/namespaces/%s/secrets?watch=true&allowWatchBookmarks=true&resourceVersion=%s"
+	// allSecretsWatchEndpoint is the path to fetch kubernetes secrets across all namespaces
+	allSecretsWatchEndpoint = "%s/api/v1/secrets?watch=true&allowWatchBookmarks=true&resourceVersion=%s"
 
 	// APIHostKubectlProxy is the typical API host to use when using kubectl proxy in the pod
 	APIHostKubectlProxy = "http://127.0.0.1:8001"
 	// DefaultNamespace is the default kubernetes namespace
 	DefaultNamespace = "default"
+	// AllNamespaces can be used instead of a namespace to watch the secrets in all namespaces
+	AllNamespaces = ""
 )
 
 // secret is used to deserialize k8s secrets from JSON
@@ -29,41 +33,112 @@ type secret struct {
 	Kind       string                 `json:"kind"`
 	ApiVersion string                 `json:"apiVersion"`
 	Metadata   map[string]interface{} `json:"metadata"`
-	Data       map[string][]byte      `json:"data"`
+	Data       secretData             `json:"data"`
+	StringData map[string]string      `json:"stringData"`
 	Type       string                 `json:"type"`
 }
 
+// UnmarshalJSON decodes a secret, adding the plain text values in stringData to its data for the keys data lacks.
+// The API server only returns data, but some tooling and test fixtures provide stringData, like the manifests secrets are created from.
+func (s *secret) UnmarshalJSON(b []byte) error {
+	type plain secret
+	if err := json.Unmarshal(b, (*plain)(s)); err != nil {
+		return err
+	}
+
+	for key, value := range s.StringData {
+		if _, ok := s.Data[key]; ok {
+			continue
+		}
+		if s.Data == nil {
+			s.Data = make(secretData, len(s.StringData))
+		}
+		s.Data[key] = []byte(value)
+	}
+	return nil
+}
+
+// secretData holds the data of a secret, by key
+type secretData map[string][]byte
+
+// UnmarshalJSON decodes the base64 encoded values sent by the API server.
+// Values that aren't valid base64 are used as is, as some proxies and test fixtures provide them already decoded, e.g. as raw PEM.
+func (d *secretData) UnmarshalJSON(b []byte) error {
+	var raw map[string]string
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*d = make(secretData, len(raw))
+	for key, value := range raw {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			decoded = []byte(value)
+		}
+		(*d)[key] = decoded
+	}
+	return nil
+}
+
 type secretEvent struct {
 	Type   string `json:"type"`
 	Object secret `json:"object"`
 }
 
+// watchEvent is used to deserialize events from the watch endpoint, before knowing what kind of object they carry
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// status is used to deserialize k8s Status objects, which are sent instead of the watched object on errors
+type status struct {
+	Kind    string `json:"kind"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Code    int    `json:"code"`
+}
+
+// secretList is used to deserialize the response of listing k8s secrets
+type secretList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []secret `json:"items"`
+}
+
 // NewTLSConfig returns a TLS config that will fetch tls certificates from kubernetes secrets with the given prefix.
 // By default, the tls.Config is configured to work with http/1.1 and http/2.
 // apiHost is the endpoint at which we can connect to kubernetes, usually this is 127.0.0.1:8001 when using kubectl proxy, which is exposed in the constant ApiHostKubectlProxy.
 // namespace is the kubernetes namespace to use, to use the default namespace, use the DefaultNamespace constant
 // hosts is the hosts to actually fetch certificates for, if left empty all hosts for which certs can be found for will be used
-func NewTLSConfig(apiHost, namespace string, hosts ...string) *tls.Config {
-	// Bookkeeping variables
-	certMap := make(map[string]*tls.Certificate)
-	mutex := new(sync.RWMutex)
-	tlsCfg := new(tls.Config)
-
-	// GetCertificate
-	tlsCfg.GetCertificate = func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-		mutex.RLock()
-		cert := certMap[clientHello.ServerName]
-		mutex.RUnlock()
+// An error is returned if the secrets endpoint can't be reached or refuses the request, in which case no monitor is started.
+func NewTLSConfig(apiHost, namespace string, hosts ...string) (*tls.Config, error) {
+	return NewTLSConfigContext(context.Background(), apiHost, namespace, hosts...)
+}
 
-		return cert, nil
+// NewTLSConfigContext is like NewTLSConfig, but the monitor backing the returned config stops once ctx is cancelled.
+// ctx also applies to the initial connection to the API server, cancelling it while connecting makes this function return an error.
+// Certificates loaded before ctx is cancelled keep being served.
+func NewTLSConfigContext(ctx context.Context, apiHost, namespace string, hosts ...string) (*tls.Config, error) {
+	m, err := NewMonitor(ctx, apiHost, namespace, WithHosts(hosts...))
+	if err != nil {
+		return nil, err
 	}
 
-	tlsCfg.NextProtos = []string{"h2", "http/1.1"}
+	return m.TLSConfig(), nil
+}
 
-	// Monitor routine
-	startMonitor(apiHost, namespace, certMap, mutex, hosts)
+// NewTLSConfigWithOptions is like NewTLSConfig, but allows customizing its behaviour through options, see the With* functions.
+// The monitor backing the returned config runs for the lifetime of the process, use NewMonitor to be able to stop it.
+func NewTLSConfigWithOptions(apiHost, namespace string, opts ...Option) (*tls.Config, error) {
+	m, err := NewMonitor(context.Background(), apiHost, namespace, opts...)
+	if err != nil {
+		return nil, err
+	}
 
-	return tlsCfg
+	return m.TLSConfig(), nil
 }
 
 // ListenAndServe directly starts a http and http/2 server
@@ -71,147 +146,175 @@ func NewTLSConfig(apiHost, namespace string, hosts ...string) *tls.Config {
 // namespace is the kubernetes namespace to use, to use the default namespace, use the DefaultNamespace constant
 // handler is the http handler to call
 // hosts is the hosts to actually fetch certificates for, if left empty all hosts for which certs can be found for will be used
+// The server uses DefaultReadHeaderTimeout and DefaultIdleTimeout, use ListenAndServeTLSServer to configure the server yourself.
 func ListenAndServeTLS(addr string, apiHost, namespace string, handler http.Handler, hosts ...string) error {
-	srv := &http.Server{Addr: addr, Handler: handler, TLSConfig: NewTLSConfig(apiHost, namespace)}
+	tlsCfg, err := NewTLSConfig(apiHost, namespace, hosts...)
+	if err != nil {
+		return err
+	}
+
+	srv := newServer(addr, handler, tlsCfg)
 	return srv.ListenAndServeTLS("", "")
 }
 
-func startMonitor(apiHost, namespace string, certMap map[string]*tls.Certificate, mutex *sync.RWMutex, hosts []string) {
-	// convert hosts to a map for convenience
-	var hostMap map[string]struct{}
-	if hosts != nil {
-		hostMap = make(map[string]struct{})
-		for _, host := range hosts {
-			hostMap[host] = struct{}{}
-		}
-	}
-
-	go func() {
-		c, errC := monitorSecretEvents(apiHost, namespace)
-		for {
-			select {
-			case event := <-c:
-
-				// Skip everything except TLS secrets
-				if event.Object.Type != "kubernetes.io/tls" {
-					continue
-				}
-
-				// Grab the secret name
-				secretName, ok := event.Object.Metadata["name"].(string)
-				if !ok {
-					log.Printf("Secret has no valid name") // Shouldn't happen
-					continue
-				}
-
-				// Grab the domain name from the labels
-				labels, ok := event.Object.Metadata["labels"].(map[string]interface{})
-				if !ok {
-					log.Printf("Ignoring secret %v due to missing label 'domain'", secretName)
-					continue
-				}
-
-				domain, ok := labels["domain"].(string)
-				if !ok {
-					log.Printf("Ignoring secret %v due to missing label 'domain'", secretName)
-					continue
-				}
-
-				switch event.Type {
-				case "ADDED", "MODIFIED":
-					if hostMap != nil {
-						if _, ok := hostMap[domain]; !ok {
-							log.Printf("[%v] Skipping domain", domain)
-							continue
-						}
-					}
-					tlsCert, err := parseCert(domain, secretName, &event.Object)
-					if err != nil {
-						log.Printf("[%v] Error while parsing TLS cert: %v", domain, err)
-						continue
-					}
-
-					mutex.Lock()
-					_, isExisting := certMap[domain]
-					certMap[domain] = &tlsCert
-					mutex.Unlock()
-
-					if !isExisting {
-						log.Printf("[%v] Added certificiate data", domain)
-					} else if event.Type == "MODIFIED" {
-						log.Printf("[%v] Updated certificate data", domain)
-					}
-				case "DELETED":
-					mutex.Lock()
-					_, exists := certMap[domain]
-					delete(certMap, domain)
-					mutex.Unlock()
-
-					if exists {
-						log.Printf("[%v] Removed certificate data", domain)
-					}
-				}
-			case err := <-errC:
-				log.Printf("Error while monitoring kubernetes secrets for SSL certs: %v", err)
-			}
+func parseCert(cfg *config, domain string, secretName string, secret *secret) (tls.Certificate, error) {
+	// Grab data from the secret
+	rawCert, ok := secret.Data[cfg.certDataKey]
+	if !ok {
+		return tls.Certificate{}, wrapError(ErrMissingTLSCrt, "Kubernetes secret '%v' does not contain %v", secretName, cfg.certDataKey)
+	}
+
+	rawKey, ok := secret.Data[cfg.keyDataKey]
+	if !ok {
+		return tls.Certificate{}, wrapError(ErrMissingTLSKey, "Kubernetes secret '%v' does not contain %v for domain %v", secretName, cfg.keyDataKey, domain)
+	}
+
+	if cfg.derDetection {
+		rawCert, rawKey = derCertsToPEM(rawCert), derKeyToPEM(rawKey)
+	}
+
+	// Decrypt PKCS#8 encrypted keys, the passphrase is either configured or stored next to the key
+	passphrase := []byte(cfg.keyPassphrase)
+	if cfg.keyPassphraseKey != "" {
+		if p, ok := secret.Data[cfg.keyPassphraseKey]; ok {
+			passphrase = p
 		}
-	}()
+	}
+	rawKey, err := decryptPEMKey(rawKey, passphrase)
+	if err == nil {
+		rawKey, err = normalizePEMKey(rawKey)
+	}
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Kubernetes secret '%v' contains an unusable %v: %w", secretName, cfg.keyDataKey, err)
+	}
+
+	// The key has to match the first certificate, so this also makes sure the leaf comes first
+	cert, err := tls.X509KeyPair(rawCert, rawKey)
+	if err != nil {
+		if leafNotFirst(rawCert, rawKey) {
+			return cert, fmt.Errorf("Kubernetes secret '%v' contains certificates before the leaf in %v, the leaf must come first", secretName, cfg.certDataKey)
+		}
+		return cert, err
+	}
+
+	// Intermediates stored under their own keys are added after the leaf, in the order in which they sign each other
+	for _, chainKey := range cfg.chainDataKeys {
+		rawChain, ok := secret.Data[chainKey]
+		if !ok {
+			continue
+		}
+		if cfg.derDetection {
+			rawChain = derCertsToPEM(rawChain)
+		}
+		if err := appendChain(&cert, rawChain); err != nil {
+			return tls.Certificate{}, fmt.Errorf("Kubernetes secret '%v' contains an invalid chain in %v: %w", secretName, chainKey, err)
+		}
+	}
+
+	// Keep the parsed leaf around, it's used for validity checks and metrics
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+	return cert, err
 }
 
-func monitorSecretEvents(apiHost, namespace string) (<-chan secretEvent, <-chan error) {
-	events := make(chan secretEvent)
-	errc := make(chan error, 1)
-	go func() {
-		resourceVersion := "0"
-		watch := func() error {
-			resp, err := http.Get(fmt.Sprintf(secretsWatchEndpoint, apiHost, namespace, resourceVersion))
-			if err != nil {
-				return err
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != 200 {
-				return errors.New("Invalid status code: " + resp.Status)
+// leafNotFirst returns whether the certificate matching the private key in rawKey isn't the first one in rawCert
+func leafNotFirst(rawCert, rawKey []byte) bool {
+	for i, rest := 0, rawCert; ; i++ {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return false
+		}
+		if i > 0 && block.Type == "CERTIFICATE" {
+			if _, err := tls.X509KeyPair(pem.EncodeToMemory(block), rawKey); err == nil {
+				return true
 			}
+		}
+	}
+}
 
-			decoder := json.NewDecoder(resp.Body)
-			for {
-				var event secretEvent
-				err = decoder.Decode(&event)
-				if err != nil {
-					if err != io.EOF {
-						return err
-					}
-					break
-				}
-				if s, ok := event.Object.Metadata["resourceVersion"].(string); ok {
-					resourceVersion = s
-				}
-				events <- event
-			}
-			return nil
+// leafCertificate parses the first certificate found in the certificate data of the secret, tls.crt by default.
+// When the data holds a concatenated chain, only the leaf is parsed, so the names of intermediates never end up being served.
+func leafCertificate(cfg *config, secret *secret) (*x509.Certificate, error) {
+	rest := secret.Data[cfg.certDataKey]
+	if cfg.derDetection {
+		rest = derCertsToPEM(rest)
+	}
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, fmt.Errorf("No certificate found in %v", cfg.certDataKey)
 		}
-		for {
-			if err := watch(); err != nil {
-				errc <- err
-			}
-			time.Sleep(5 * time.Second)
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
 		}
-	}()
+	}
+}
 
-	return events, errc
+// checkValidity returns an error if the leaf certificate isn't valid at the given time
+func checkValidity(cert *tls.Certificate, now time.Time) error {
+	if now.Before(cert.Leaf.NotBefore) {
+		return fmt.Errorf("certificate is not valid before %v", cert.Leaf.NotBefore)
+	}
+	if now.After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %v", cert.Leaf.NotAfter)
+	}
+	return nil
 }
 
-func parseCert(domain string, secretName string, secret *secret) (tls.Certificate, error) {
-	// Grab data from the secret
-	rawCert, ok := secret.Data["tls.crt"]
-	if !ok {
-		return tls.Certificate{}, fmt.Errorf("Kubernetes secret '%v' does not contain tls.crt", secretName)
+// appendChain adds the intermediate certificates in rawCA to the chain of cert, in the order in which they sign each other.
+// Self-signed roots and certificates already in the chain are skipped, an error is returned for certificates that don't fit in the chain, those aren't added.
+func appendChain(cert *tls.Certificate, rawCA []byte) error {
+	present := make(map[string]struct{}, len(cert.Certificate))
+	for _, der := range cert.Certificate {
+		present[string(der)] = struct{}{}
 	}
 
-	rawKey, ok := secret.Data["tls.key"]
-	if !ok {
-		return tls.Certificate{}, fmt.Errorf("Kubernetes secret '%v' does not contain tls.key for domain %v", secretName)
+	var pending []*x509.Certificate
+	for rest := rawCA; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		if _, ok := present[string(ca.Raw)]; ok || ca.CheckSignatureFrom(ca) == nil {
+			continue
+		}
+		pending = append(pending, ca)
+	}
+
+	last, err := x509.ParseCertificate(cert.Certificate[len(cert.Certificate)-1])
+	if err != nil {
+		return err
+	}
+
+	// Keep appending whichever pending certificate signed the last one in the chain
+	for len(pending) > 0 {
+		found := -1
+		for i, ca := range pending {
+			if last.CheckSignatureFrom(ca) == nil {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			return fmt.Errorf("%d certificate(s) don't chain to the leaf", len(pending))
+		}
+
+		last = pending[found]
+		cert.Certificate = append(cert.Certificate, last.Raw)
+		pending = append(pending[:found], pending[found+1:]...)
 	}
 
-	return tls.X509KeyPair(rawCert, rawKey)
+	return nil
 }
@@ -0,0 +1,233 @@
+package kubecerthttp_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	kubecerthttp "github.com/PalmStoneGames/kube-cert-http"
+	"github.com/PalmStoneGames/kube-cert-http/kubefake"
+)
+
+func TestMissingKeyError(t *testing.T) {
+	crt, _ := newCert(t, "a.example.com")
+	s := tlsSecret("a", "a.example.com", crt, nil)
+	delete(s.Data, "tls.key")
+	api := kubefake.NewServer(s)
+	defer api.Close()
+
+	_, errs := kubecerthttp.Validate(api.URL, "default")
+	if len(errs) != 1 {
+		t.Fatalf("Got errors %v, want one", errs)
+	}
+	err := errs[0]
+	if !errors.Is(err, kubecerthttp.ErrMissingTLSKey) {
+		t.Errorf("Error %q doesn't match ErrMissingTLSKey", err)
+	}
+	want := "Kubernetes secret 'default/a' does not contain tls.key for domain a.example.com"
+	if msg := err.Error(); !strings.Contains(msg, want) || strings.Contains(msg, "%!") {
+		t.Errorf("Error is %q, want it to contain %q", msg, want)
+	}
+}
+
+// listServer returns an API server listing the given secrets as is, like a recorded response
+func listServer(t *testing.T, items ...map[string]interface{}) *httptest.Server {
+	t.Helper()
+	body, err := json.Marshal(map[string]interface{}{
+		"kind":     "SecretList",
+		"metadata": map[string]interface{}{"resourceVersion": "1"},
+		"items":    items,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(body)
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+// rawSecret returns a TLS secret in the default namespace for domain, in the form the API server sends it in, with data as given
+func rawSecret(name, domain string, data map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{"name": name, "namespace": "default", "labels": map[string]string{"domain": domain}},
+		"type":     "kubernetes.io/tls",
+		"data":     data,
+	}
+}
+
+func TestDecodedSecretData(t *testing.T) {
+	crtA, keyA := newCert(t, "a.example.com")
+	crtB, keyB := newCert(t, "b.example.com")
+	crtC, keyC := newCert(t, "c.example.com")
+	plain := rawSecret("c", "c.example.com", nil)
+	delete(plain, "data")
+	plain["stringData"] = map[string]string{"tls.crt": string(crtC), "tls.key": string(keyC)}
+
+	api := listServer(t,
+		rawSecret("a", "a.example.com", map[string]string{"tls.crt": base64.StdEncoding.EncodeToString(crtA), "tls.key": base64.StdEncoding.EncodeToString(keyA)}),
+		rawSecret("b", "b.example.com", map[string]string{"tls.crt": string(crtB), "tls.key": string(keyB)}),
+		plain,
+	)
+
+	infos, errs := kubecerthttp.Validate(api.URL, "default")
+	if len(errs) != 0 {
+		t.Fatalf("Unexpected errors %v", errs)
+	}
+	for _, domain := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		if info, ok := infos[domain]; !ok || info.DNSNames[0] != domain {
+			t.Errorf("Certificate for %v not loaded, got %+v", domain, info)
+		}
+	}
+}
+
+func TestKeyFormats(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8 := func(key interface{}) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecParams := pem.EncodeToMemory(&pem.Block{Type: "EC PARAMETERS", Bytes: []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}})
+	rsaCrt, ecCrt := selfSigned(t, rsaKey, "rsa.example.com"), selfSigned(t, ecKey, "ec.example.com")
+
+	for _, tt := range []struct {
+		name string
+		crt  []byte
+		key  []byte
+	}{
+		{"PKCS#1 RSA", rsaCrt, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})},
+		{"PKCS#8 RSA", rsaCrt, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8(rsaKey)})},
+		{"PKCS#1 RSA in a PRIVATE KEY block", rsaCrt, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})},
+		{"SEC 1 EC", ecCrt, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})},
+		{"SEC 1 EC after EC PARAMETERS", ecCrt, append(ecParams, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})...)},
+		{"PKCS#8 EC", ecCrt, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8(ecKey)})},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			api := kubefake.NewServer(tlsSecret("a", "a.example.com", tt.crt, tt.key))
+			defer api.Close()
+
+			infos, errs := kubecerthttp.Validate(api.URL, "default")
+			if len(errs) != 0 {
+				t.Fatalf("Unexpected errors %v", errs)
+			}
+			if _, ok := infos["a.example.com"]; !ok {
+				t.Fatal("Certificate not loaded")
+			}
+		})
+	}
+
+	// Without a key, the error names the blocks that were found instead
+	api := kubefake.NewServer(tlsSecret("a", "a.example.com", ecCrt, append(ecParams, ecCrt...)))
+	defer api.Close()
+	_, errs := kubecerthttp.Validate(api.URL, "default")
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "only EC PARAMETERS, CERTIFICATE blocks") {
+		t.Fatalf("Got errors %v, want one naming the blocks found", errs)
+	}
+}
+
+func TestDERCertificates(t *testing.T) {
+	crt, key := newCert(t, "der.example.com")
+	crtBlock, _ := pem.Decode(crt)
+	keyBlock, _ := pem.Decode(key)
+	pemCrt, pemKey := newCert(t, "pem.example.com")
+	api := kubefake.NewServer(tlsSecret("der", "der.example.com", crtBlock.Bytes, keyBlock.Bytes))
+	defer api.Close()
+
+	m := startMonitor(t, api)
+	waitFor(t, "der.example.com to be served", func() bool { return serves(m, "der.example.com", crt) })
+
+	// Without detection, DER data is passed on as is and fails to load, the secret added afterwards shows it was handled
+	m = startMonitor(t, api, kubecerthttp.WithoutDERDetection())
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("pem", "pem.example.com", pemCrt, pemKey)})
+	waitFor(t, "pem.example.com to be served", func() bool { return serves(m, "pem.example.com", pemCrt) })
+	if serves(m, "der.example.com", crt) {
+		t.Error("DER certificate loaded with WithoutDERDetection")
+	}
+}
+
+func TestConcatenatedChainSANs(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		DNSNames:              []string{"ca.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com", "www.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, caTmpl, leafKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafCrt := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	chain := append(leafCrt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...)
+	key := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	api := kubefake.NewServer(tlsSecret("a", "example.com", chain, key))
+	defer api.Close()
+
+	m := startMonitor(t, api, kubecerthttp.WithSANDomains())
+	waitFor(t, "www.example.com to be served", func() bool { return serves(m, "www.example.com", leafCrt) })
+	if serves(m, "ca.example.com", leafCrt) {
+		t.Error("The names of the CA are served")
+	}
+	cert, _ := m.Get("www.example.com")
+	if len(cert.Certificate) != 2 || !bytes.Equal(cert.Certificate[1], caDER) {
+		t.Errorf("Served chain has %v certificates, want the leaf and the CA", len(cert.Certificate))
+	}
+}
@@ -0,0 +1,34 @@
+package kubecerthttp
+
+import (
+	"crypto/x509"
+	"log/slog"
+)
+
+// updateClientCAs rebuilds the client CA pool from the ca.crt in the client CA secret
+func (m *Monitor) updateClientCAs(secretKey string, event secretEvent) {
+	var pool *x509.CertPool
+	switch event.Type {
+	case "ADDED", "MODIFIED":
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(event.Object.Data["ca.crt"]) {
+			m.log.logf(slog.LevelError, "Kubernetes secret '%v' does not contain any valid certificates in ca.crt", secretKey)
+			return
+		}
+	case "DELETED":
+	default:
+		return
+	}
+
+	m.mutex.Lock()
+	m.clientCAs = pool
+	m.updateClientConfig()
+	m.publish()
+	m.mutex.Unlock()
+
+	if pool == nil {
+		m.log.logf(slog.LevelWarn, "Removed client CA certificates, secret %v was deleted", secretKey)
+	} else {
+		m.log.logf(slog.LevelInfo, "Updated client CA certificates from secret %v", secretKey)
+	}
+}
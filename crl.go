@@ -0,0 +1,104 @@
+package kubecerthttp
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// errNoClientCRL is returned during handshakes while the client CRL secret isn't loaded
+var errNoClientCRL = errors.New("Client certificate revocation list hasn't been loaded")
+
+// clientCRL is a parsed certificate revocation list, along with the serial numbers it revokes for quick lookups
+type clientCRL struct {
+	list    *x509.RevocationList
+	revoked map[string]time.Time // serial number -> revocation time
+}
+
+// updateClientCRL reparses the revocation list from the ca.crl in the client CRL secret
+func (m *Monitor) updateClientCRL(secretKey string, event secretEvent) {
+	var crl *clientCRL
+	switch event.Type {
+	case "ADDED", "MODIFIED":
+		var err error
+		if crl, err = parseCRL(event.Object.Data["ca.crl"]); err != nil {
+			m.log.logf(slog.LevelError, "Kubernetes secret '%v' does not contain a valid certificate revocation list in ca.crl: %v", secretKey, err)
+			return
+		}
+	case "DELETED":
+	default:
+		return
+	}
+
+	m.mutex.Lock()
+	m.clientCRL = crl
+	m.publish()
+	m.mutex.Unlock()
+
+	switch {
+	case crl == nil:
+		m.log.logf(slog.LevelWarn, "Removed client certificate revocation list, secret %v was deleted", secretKey)
+	case !crl.list.NextUpdate.IsZero() && time.Now().After(crl.list.NextUpdate):
+		m.log.logf(slog.LevelWarn, "Updated client certificate revocation list from secret %v, but it was due to be updated on %v", secretKey, crl.list.NextUpdate.Format(time.RFC3339))
+	default:
+		m.log.logf(slog.LevelInfo, "Updated client certificate revocation list from secret %v, %v certificates are revoked", secretKey, len(crl.revoked))
+	}
+}
+
+// parseCRL parses a PEM or DER encoded certificate revocation list
+func parseCRL(data []byte) (*clientCRL, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("Unexpected PEM block of type %v", block.Type)
+		}
+		data = block.Bytes
+	}
+
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+
+	crl := &clientCRL{list: list, revoked: make(map[string]time.Time, len(list.RevokedCertificateEntries))}
+	for _, entry := range list.RevokedCertificateEntries {
+		crl.revoked[entry.SerialNumber.String()] = entry.RevocationTime
+	}
+	return crl, nil
+}
+
+// verifyPeerCertificate is used as VerifyPeerCertificate when a client CRL secret is set, it rejects client certificates revoked by the list
+func (m *Monitor) verifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	crl := m.lookup.Load().clientCRL
+
+	if crl == nil {
+		return errNoClientCRL
+	}
+
+	// Without client CAs there are no verified chains, so only the leaf can be checked
+	if len(verifiedChains) == 0 {
+		if len(rawCerts) == 0 {
+			return nil
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		verifiedChains = [][]*x509.Certificate{{leaf}}
+	}
+
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if !bytes.Equal(cert.RawIssuer, crl.list.RawIssuer) {
+				continue
+			}
+			if revokedAt, ok := crl.revoked[cert.SerialNumber.String()]; ok {
+				return fmt.Errorf("Client certificate %q with serial number %v was revoked on %v", cert.Subject.String(), cert.SerialNumber, revokedAt.Format(time.RFC3339))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package kubecerthttp_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	kubecerthttp "github.com/PalmStoneGames/kube-cert-http"
+	"github.com/PalmStoneGames/kube-cert-http/kubefake"
+)
+
+func TestClientCRL(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// clientCert returns a client certificate issued by the CA with the given serial number
+	clientCert := func(serial int64) []byte {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "client"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, key.Public(), caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	revoked, valid := clientCert(2), clientCert(3)
+
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-time.Hour),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: big.NewInt(2), RevocationTime: time.Now().Add(-time.Minute)}},
+	}, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlSecret := kubefake.Secret{Namespace: "default", Name: "client-crl", Type: "Opaque", Data: map[string][]byte{"ca.crl": pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER})}}
+
+	api := kubefake.NewServer()
+	defer api.Close()
+	m := startMonitor(t, api, kubecerthttp.WithClientCRLSecret("client-crl"))
+	verify := m.TLSConfig().VerifyPeerCertificate
+	if verify == nil {
+		t.Fatal("VerifyPeerCertificate isn't set")
+	}
+
+	// Until the list is loaded, no client certificate is accepted
+	if err := verify([][]byte{valid}, nil); err == nil || !strings.Contains(err.Error(), "hasn't been loaded") {
+		t.Fatalf("Verifying before the list is loaded returned %v", err)
+	}
+
+	api.Send(kubefake.Event{Type: "ADDED", Secret: crlSecret})
+	waitFor(t, "the revocation list to be loaded", func() bool { return verify([][]byte{valid}, nil) == nil })
+
+	if err := verify([][]byte{revoked}, nil); err == nil || !strings.Contains(err.Error(), "was revoked") {
+		t.Errorf("Verifying a revoked certificate returned %v", err)
+	}
+
+	// With client CAs, the verified chains are checked
+	if err := verify(nil, [][]*x509.Certificate{{mustParse(t, revoked), ca}}); err == nil {
+		t.Error("A revoked certificate in a verified chain was accepted")
+	}
+	if err := verify(nil, [][]*x509.Certificate{{mustParse(t, valid), ca}}); err != nil {
+		t.Errorf("A valid certificate in a verified chain was rejected: %v", err)
+	}
+}
+
+// mustParse parses a DER encoded certificate, failing the test if it is invalid
+func mustParse(t *testing.T, der []byte) *x509.Certificate {
+	t.Helper()
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
@@ -0,0 +1,93 @@
+package kubecerthttp
+
+import (
+	"time"
+)
+
+// debouncer coalesces bursts of MODIFIED events for the same secret, so only the latest version of the secret is processed.
+// Other events are never delayed, and drop any pending MODIFIED event for their secret since they supersede it.
+type debouncer struct {
+	window  time.Duration
+	pending map[string]*pendingEvent
+	timer   *time.Timer
+}
+
+// pendingEvent is the latest MODIFIED event for a secret, to be processed at due
+type pendingEvent struct {
+	event secretEvent
+	due   time.Time
+}
+
+func newDebouncer(window time.Duration) *debouncer {
+	return &debouncer{
+		window:  window,
+		pending: make(map[string]*pendingEvent),
+	}
+}
+
+// add returns the events that need to be processed right away
+func (d *debouncer) add(event secretEvent) []secretEvent {
+	if d.window <= 0 {
+		return []secretEvent{event}
+	}
+
+	name, _ := event.Object.Metadata["name"].(string)
+	namespace, _ := event.Object.Metadata["namespace"].(string)
+	key := namespace + "/" + name
+
+	if event.Type != "MODIFIED" {
+		delete(d.pending, key)
+		d.rearm()
+		return []secretEvent{event}
+	}
+
+	// The window starts at the first event of a burst, so a constant stream of changes still gets processed
+	if p, ok := d.pending[key]; ok {
+		p.event = event
+	} else {
+		d.pending[key] = &pendingEvent{event: event, due: time.Now().Add(d.window)}
+		d.rearm()
+	}
+	return nil
+}
+
+// C returns a channel that fires when pending events are due, or nil when nothing is pending
+func (d *debouncer) C() <-chan time.Time {
+	if d.timer == nil {
+		return nil
+	}
+	return d.timer.C
+}
+
+// flush returns the pending events that are due, or all of them if all is set
+func (d *debouncer) flush(all bool) []secretEvent {
+	var due []secretEvent
+	now := time.Now()
+	for key, p := range d.pending {
+		if all || !now.Before(p.due) {
+			due = append(due, p.event)
+			delete(d.pending, key)
+		}
+	}
+
+	d.rearm()
+	return due
+}
+
+// rearm sets the timer to fire when the first pending event is due
+func (d *debouncer) rearm() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+
+	var first time.Time
+	for _, p := range d.pending {
+		if first.IsZero() || p.due.Before(first) {
+			first = p.due
+		}
+	}
+	if !first.IsZero() {
+		d.timer = time.NewTimer(time.Until(first))
+	}
+}
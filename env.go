@@ -0,0 +1,70 @@
+package kubecerthttp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// EnvAPIHost is the environment variable NewTLSConfigFromEnv reads the API host from, APIHostKubectlProxy is used if it isn't set
+	EnvAPIHost = "KUBE_API_HOST"
+	// EnvNamespace is the environment variable NewTLSConfigFromEnv reads the namespace from, DefaultNamespace is used if it isn't set
+	EnvNamespace = "KUBE_NAMESPACE"
+	// EnvCertHosts is the environment variable NewTLSConfigFromEnv reads the comma separated hosts to fetch certificates for from, all hosts are used if it isn't set
+	EnvCertHosts = "KUBE_CERT_HOSTS"
+)
+
+// NewTLSConfigFromEnv is like NewTLSConfigWithOptions, but reads the API host, namespace and hosts from the KUBE_API_HOST, KUBE_NAMESPACE and KUBE_CERT_HOSTS environment variables.
+// This allows configuring many services the same way. An error is returned if any of them is malformed.
+func NewTLSConfigFromEnv(opts ...Option) (*tls.Config, error) {
+	apiHost, namespace, hosts, err := configFromEnv(os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTLSConfigWithOptions(apiHost, namespace, append([]Option{WithHosts(hosts...)}, opts...)...)
+}
+
+// configFromEnv reads the API host, namespace and hosts from the environment variables looked up through lookup
+func configFromEnv(lookup func(key string) (string, bool)) (apiHost, namespace string, hosts []string, err error) {
+	apiHost = APIHostKubectlProxy
+	if value, ok := lookup(EnvAPIHost); ok {
+		if apiHost, err = normalizeAPIHost(strings.TrimSpace(value)); err != nil {
+			return "", "", nil, fmt.Errorf("Invalid %v: %v", EnvAPIHost, err)
+		}
+	}
+
+	namespace = DefaultNamespace
+	if value, ok := lookup(EnvNamespace); ok {
+		namespace = strings.TrimSpace(value)
+		if !isDNSLabel(namespace) {
+			return "", "", nil, fmt.Errorf("Invalid %v %q: must be a lower case DNS label", EnvNamespace, value)
+		}
+	}
+
+	if value, ok := lookup(EnvCertHosts); ok && strings.TrimSpace(value) != "" {
+		for _, host := range strings.Split(value, ",") {
+			host = strings.TrimSpace(host)
+			if host == "" || strings.ContainsAny(host, " \t/:") {
+				return "", "", nil, fmt.Errorf("Invalid %v %q: must be a comma separated list of hosts", EnvCertHosts, value)
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	return apiHost, namespace, hosts, nil
+}
+
+// isDNSLabel returns whether s is a valid kubernetes namespace name, a lower case RFC 1123 label
+func isDNSLabel(s string) bool {
+	if len(s) == 0 || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,36 @@
+package kubecerthttp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors for secrets that can't be loaded, they can be matched using errors.Is.
+// The errors returned by this package wrap them, while giving a more detailed message.
+var (
+	// ErrMissingTLSCrt is returned for secrets without certificate data, which is stored in tls.crt unless configured otherwise through WithDataKeys
+	ErrMissingTLSCrt = errors.New("Secret does not contain a certificate")
+	// ErrMissingTLSKey is returned for secrets without private key data, which is stored in tls.key unless configured otherwise through WithDataKeys
+	ErrMissingTLSKey = errors.New("Secret does not contain a private key")
+	// ErrInvalidCertificate is returned for certificates that are expired or not valid yet
+	ErrInvalidCertificate = errors.New("Certificate is not valid")
+)
+
+// wrappedError has a message of its own, but matches the error it wraps through errors.Is
+type wrappedError struct {
+	msg string
+	err error
+}
+
+func (e *wrappedError) Error() string {
+	return e.msg
+}
+
+func (e *wrappedError) Unwrap() error {
+	return e.err
+}
+
+// wrapError returns an error with the formatted message that wraps err
+func wrapError(err error, format string, args ...interface{}) error {
+	return &wrappedError{fmt.Sprintf(format, args...), err}
+}
@@ -0,0 +1,125 @@
+package kubecerthttp
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// expiryCheckInterval is how often the served certificates are checked for expiring soon
+const expiryCheckInterval = time.Minute
+
+// runExpiryChecker warns about served certificates that expire within the configured threshold until ctx is cancelled
+func (m *Monitor) runExpiryChecker(ctx context.Context) {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+
+	// Certificates are only reported once, stapled copies share their leaf with the original
+	warned := make(map[*x509.Certificate]struct{})
+	for {
+		m.checkExpiry(time.Now(), warned)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkExpiry reports the served certificates expiring within the threshold that aren't in warned yet, and forgets about the ones no longer served
+func (m *Monitor) checkExpiry(now time.Time, warned map[*x509.Certificate]struct{}) {
+	var expiring []certChange
+	served := make(map[*x509.Certificate]struct{})
+
+	m.mutex.RLock()
+	for domain, certs := range m.certMap {
+		for _, cert := range certs {
+			if cert.Leaf == nil {
+				continue
+			}
+			served[cert.Leaf] = struct{}{}
+			if _, ok := warned[cert.Leaf]; ok || now.Add(m.cfg.expiryWarning).Before(cert.Leaf.NotAfter) {
+				continue
+			}
+			expiring = append(expiring, certChange{domain, cert})
+		}
+	}
+	m.mutex.RUnlock()
+
+	for leaf := range warned {
+		if _, ok := served[leaf]; !ok {
+			delete(warned, leaf)
+		}
+	}
+
+	for _, change := range expiring {
+		warned[change.cert.Leaf] = struct{}{}
+		m.metrics.expiryWarnings.Add(1)
+		m.log.domainf(slog.LevelWarn, change.domain, "Certificate expires in %v, at %v", change.cert.Leaf.NotAfter.Sub(now).Round(time.Minute), change.cert.Leaf.NotAfter.Format(time.RFC3339))
+		if m.cfg.onExpiring != nil {
+			m.cfg.onExpiring(change.domain, change.cert)
+		}
+	}
+}
+
+// SkippedCert is a secret whose certificate isn't served because it expired, see SkippedCerts
+type SkippedCert struct {
+	Secret   string // namespace/name of the secret
+	Domains  []string
+	NotAfter time.Time
+}
+
+// SkippedCerts returns the secrets that aren't served because their certificate expired, sorted by secret, so they can be cleaned up.
+// A summary is logged after every list of the secrets as well. Expired certificates are only skipped while the validity check is enabled, see WithoutValidityCheck.
+func (m *Monitor) SkippedCerts() []SkippedCert {
+	m.handling.Lock()
+	defer m.handling.Unlock()
+	return m.sortedSkipped()
+}
+
+// sortedSkipped returns the skipped certificates sorted by secret, the caller must hold m.handling
+func (m *Monitor) sortedSkipped() []SkippedCert {
+	skipped := make([]SkippedCert, 0, len(m.skipped))
+	for _, s := range m.skipped {
+		skipped = append(skipped, s)
+	}
+	sort.Slice(skipped, func(i, j int) bool {
+		return skipped[i].Secret < skipped[j].Secret
+	})
+	return skipped
+}
+
+// recordSkipped remembers a secret whose certificate couldn't be loaded if that's because it expired, the caller must hold m.handling
+func (m *Monitor) recordSkipped(secretKey string, domains []string, s *secret, err error) {
+	if !errors.Is(err, ErrInvalidCertificate) {
+		return
+	}
+	leaf, err := leafCertificate(m.cfg, s)
+	if err != nil || time.Now().Before(leaf.NotAfter) {
+		return
+	}
+	m.skipped[secretKey] = SkippedCert{Secret: secretKey, Domains: domains, NotAfter: leaf.NotAfter}
+}
+
+// logSkipped logs a summary of the skipped certificates, after the secrets have been listed
+func (m *Monitor) logSkipped() {
+	m.handling.Lock()
+	skipped := m.sortedSkipped()
+	m.handling.Unlock()
+
+	if len(skipped) == 0 {
+		return
+	}
+
+	summary := make([]string, 0, len(skipped))
+	for _, s := range skipped {
+		summary = append(summary, fmt.Sprintf("%v (%v, expired at %v)", s.Secret, strings.Join(s.Domains, ", "), s.NotAfter.Format(time.RFC3339)))
+	}
+	m.log.logf(slog.LevelWarn, "Skipped %d secrets with expired certificates: %v", len(skipped), strings.Join(summary, "; "))
+}
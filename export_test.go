@@ -0,0 +1,11 @@
+package kubecerthttp
+
+import "net/http"
+
+// NewTokenRoundTripper exposes tokenRoundTripper to the tests
+func NewTokenRoundTripper(tokenFile string, next http.RoundTripper) http.RoundTripper {
+	return &tokenRoundTripper{tokenFile: tokenFile, next: next}
+}
+
+// NewInClusterMonitor exposes newInClusterMonitor to the tests, so they can use their own service account directory and API server
+var NewInClusterMonitor = newInClusterMonitor
@@ -0,0 +1,181 @@
+package kubecerthttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// NewFileTLSConfig returns a TLS config like NewTLSConfig, but loads the certificates from PEM files in dir instead of kubernetes secrets.
+// This is mostly useful for local development, where there is no kubernetes API to watch.
+// hosts is the hosts to actually fetch certificates for, if left empty all hosts for which certs can be found for will be used
+func NewFileTLSConfig(dir string, hosts ...string) (*tls.Config, error) {
+	m, err := NewFileMonitor(context.Background(), dir, WithHosts(hosts...))
+	if err != nil {
+		return nil, err
+	}
+
+	return m.TLSConfig(), nil
+}
+
+// NewFileMonitor is like NewMonitor, but loads the certificates from PEM files in dir instead of kubernetes secrets.
+// Two layouts are supported, which can be mixed: {domain}.crt and {domain}.key files, or {domain}/tls.crt and {domain}/tls.key in a subdirectory.
+// The directory is only read once, unless WithFilePollInterval is used to pick up changes.
+// An error is returned if the directory can't be read.
+func NewFileMonitor(ctx context.Context, dir string, opts ...Option) (*Monitor, error) {
+	cfg := newConfig(opts)
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	m := newMonitor(cfg)
+	err := m.start(ctx, []eventSource{func(ctx context.Context) (<-chan secretEvent, <-chan error, error) {
+		return monitorFileEvents(ctx, cfg, dir)
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// certFiles is the content of a certificate and its key
+type certFiles struct {
+	crt, key []byte
+}
+
+// monitorFileEvents turns the certificates in dir into secret events, the initial scan is done synchronously so an unreadable directory is reported to the caller.
+// When polling is enabled, the directory is rescanned and changes are sent as MODIFIED and DELETED events.
+func monitorFileEvents(ctx context.Context, cfg *config, dir string) (<-chan secretEvent, <-chan error, error) {
+	events := make(chan secretEvent)
+	errc := make(chan error, 1)
+
+	current, err := scanCertFiles(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	go func() {
+		defer close(events)
+
+		send := func(eventType, domain string, files certFiles) bool {
+			event := secretEvent{Type: eventType, Object: secret{
+				Kind: "Secret",
+				Type: cfg.secretTypes[0],
+				Metadata: map[string]interface{}{
+					"name":      domain,
+					"namespace": dir,
+					"labels":    map[string]interface{}{cfg.domainLabel: domain},
+				},
+				Data: map[string][]byte{cfg.certDataKey: files.crt, cfg.keyDataKey: files.key},
+			}}
+
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for domain, files := range current {
+			if !send("ADDED", domain, files) {
+				return
+			}
+		}
+
+		if cfg.filePollInterval <= 0 {
+			<-ctx.Done()
+			return
+		}
+
+		ticker := time.NewTicker(cfg.filePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			scanned, err := scanCertFiles(dir)
+			if err != nil {
+				select {
+				case errc <- err:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			for domain, files := range scanned {
+				previous, ok := current[domain]
+				switch {
+				case !ok:
+					if !send("ADDED", domain, files) {
+						return
+					}
+				case !bytes.Equal(previous.crt, files.crt) || !bytes.Equal(previous.key, files.key):
+					if !send("MODIFIED", domain, files) {
+						return
+					}
+				}
+			}
+			for domain, files := range current {
+				if _, ok := scanned[domain]; !ok {
+					if !send("DELETED", domain, files) {
+						return
+					}
+				}
+			}
+			current = scanned
+		}
+	}()
+
+	return events, errc, nil
+}
+
+// scanCertFiles reads all the certificate and key pairs in dir, by domain
+func scanCertFiles(dir string) (map[string]certFiles, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]certFiles)
+	for _, entry := range entries {
+		var domain, crtPath, keyPath string
+		switch {
+		case entry.IsDir():
+			domain = entry.Name()
+			crtPath = filepath.Join(dir, domain, "tls.crt")
+			keyPath = filepath.Join(dir, domain, "tls.key")
+		case strings.HasSuffix(entry.Name(), ".crt"):
+			domain = strings.TrimSuffix(entry.Name(), ".crt")
+			crtPath = filepath.Join(dir, entry.Name())
+			keyPath = filepath.Join(dir, domain+".key")
+		default:
+			continue
+		}
+
+		crt, err := os.ReadFile(crtPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		key, err := os.ReadFile(keyPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		found[domain] = certFiles{crt, key}
+	}
+
+	return found, nil
+}
@@ -0,0 +1,79 @@
+package kubecerthttp_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"testing"
+
+	kubecerthttp "github.com/PalmStoneGames/kube-cert-http"
+)
+
+// benchmarkMonitor returns an unstarted monitor serving static certificates for 100 domains, and keeps changing its TLS settings until the benchmark ends
+func benchmarkMonitor(b *testing.B) *kubecerthttp.Monitor {
+	b.Helper()
+	certs := make(map[string]tls.Certificate)
+	for i := 0; i < 100; i++ {
+		domain := fmt.Sprintf("%d.example.com", i)
+		crt, key := newCert(b, domain)
+		cert, err := tls.X509KeyPair(crt, key)
+		if err != nil {
+			b.Fatal(err)
+		}
+		certs[domain] = cert
+	}
+
+	m, err := kubecerthttp.NewUnstartedMonitor("http://127.0.0.1:1", "default", kubecerthttp.WithStaticCertificates(certs))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// Writers hold the mutex while they run, handshakes must not wait for them
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				m.SetTLSSettings(kubecerthttp.TLSSettings{MinVersion: tls.VersionTLS12})
+			}
+		}
+	}()
+	b.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	return m
+}
+
+func BenchmarkGetCertificate(b *testing.B) {
+	cfg := benchmarkMonitor(b).TLSConfig()
+	hello := &tls.ClientHelloInfo{ServerName: "50.example.com"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := cfg.GetCertificate(hello); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkGetConfigForClient(b *testing.B) {
+	cfg := benchmarkMonitor(b).TLSConfig()
+	hello := &tls.ClientHelloInfo{ServerName: "50.example.com"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := cfg.GetConfigForClient(hello); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,31 @@
+//go:build http3
+
+package kubecerthttp
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// ListenAndServeQUIC is like ListenAndServeTLS, but serves HTTP/3 over QUIC on the UDP address addr, advertising "h3" through ALPN.
+// It is only available when building with the http3 tag, which adds a dependency on github.com/quic-go/quic-go.
+// Fetch it with "go get github.com/quic-go/quic-go" before building with "go build -tags http3", see the README.
+// To let clients discover HTTP/3, run it next to ListenAndServeTLS on the same port, and set the Alt-Svc header on the responses of the TCP server.
+func ListenAndServeQUIC(addr string, apiHost, namespace string, handler http.Handler, hosts ...string) error {
+	tlsCfg, err := NewTLSConfig(apiHost, namespace, hosts...)
+	if err != nil {
+		return err
+	}
+
+	// The only protocol spoken over QUIC is HTTP/3
+	quicCfg := tlsCfg.Clone()
+	quicCfg.NextProtos = []string{http3.NextProtoH3}
+
+	srv := &http3.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(quicCfg),
+	}
+	return srv.ListenAndServe()
+}
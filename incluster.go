@@ -0,0 +1,167 @@
+package kubecerthttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// APIHostInCluster is the API host to use when talking to the kubernetes API server directly from within a pod
+	APIHostInCluster = "https://kubernetes.default.svc"
+
+	// PodNamespace can be passed to NewInClusterTLSConfig instead of a namespace to use the namespace of the pod, see NamespaceFromServiceAccount
+	PodNamespace = "@pod"
+
+	// serviceAccountDir is the directory in which kubernetes mounts the service account credentials
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// tokenRefreshInterval is how often the service account token is re-read from disk, projected tokens are rotated by the kubelet
+	tokenRefreshInterval = time.Minute
+)
+
+// NewInClusterTLSConfig returns a TLS config like NewTLSConfig, but talks to the kubernetes API server directly instead of going through kubectl proxy.
+// It authenticates using the service account token and CA bundle that kubernetes mounts into every pod, the token is periodically re-read so rotated tokens are picked up.
+// The proxy set in the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables is used, add kubernetes.default.svc to NO_PROXY if the API server should be reached directly.
+// namespace is the kubernetes namespace to use, to use the default namespace, use the DefaultNamespace constant, to use the namespace the pod runs in, use the PodNamespace constant or NewInClusterPodTLSConfig
+// hosts is the hosts to actually fetch certificates for, if left empty all hosts for which certs can be found for will be used
+func NewInClusterTLSConfig(namespace string, hosts ...string) (*tls.Config, error) {
+	m, err := newInClusterMonitor(context.Background(), serviceAccountDir, APIHostInCluster, namespace, WithHosts(hosts...))
+	if err != nil {
+		return nil, err
+	}
+
+	return m.TLSConfig(), nil
+}
+
+// NewInClusterPodTLSConfig is like NewInClusterTLSConfig, but always uses the namespace the pod runs in, as read from the service account.
+// hosts is the hosts to actually fetch certificates for, if left empty all hosts for which certs can be found for will be used
+func NewInClusterPodTLSConfig(hosts ...string) (*tls.Config, error) {
+	return NewInClusterTLSConfig(PodNamespace, hosts...)
+}
+
+// newInClusterMonitor starts a monitor talking to the API server at apiHost with the service account found in dir, resolving PodNamespace to the namespace of the service account
+func newInClusterMonitor(ctx context.Context, dir, apiHost, namespace string, opts ...Option) (*Monitor, error) {
+	client, err := inClusterClient(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if namespace == PodNamespace {
+		if namespace, err = serviceAccountNamespace(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewMonitor(ctx, apiHost, namespace, append(opts, WithHTTPClient(client))...)
+}
+
+// NamespaceFromServiceAccount returns the namespace the pod runs in, as mounted by kubernetes next to the service account token.
+// This avoids hardcoding the namespace when the same image is deployed to multiple namespaces, an error is returned when not running in a pod.
+func NamespaceFromServiceAccount() (string, error) {
+	return serviceAccountNamespace(serviceAccountDir)
+}
+
+// serviceAccountNamespace reads the namespace of the service account found in dir
+func serviceAccountNamespace(dir string) (string, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, "namespace"))
+	if err != nil {
+		return "", err
+	}
+
+	namespace := strings.TrimSpace(string(raw))
+	if namespace == "" {
+		return "", errors.New("Service account namespace file is empty")
+	}
+	return namespace, nil
+}
+
+// inClusterClient builds a http client that trusts the service account CA and authenticates with the service account token found in dir
+func inClusterClient(dir string) (*http.Client, error) {
+	rawCA, err := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(rawCA) {
+		return nil, errors.New("No valid certificates found in service account ca.crt")
+	}
+
+	rt := &tokenRoundTripper{
+		tokenFile: filepath.Join(dir, "token"),
+		next:      &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+
+	// Read the token once up front so a missing token is reported immediately
+	if _, err := rt.token(); err != nil {
+		return nil, err
+	}
+
+	return &http.Client{Transport: rt}, nil
+}
+
+// tokenRoundTripper adds a bearer token read from tokenFile to every request
+type tokenRoundTripper struct {
+	tokenFile string
+	next      http.RoundTripper
+
+	mutex    sync.Mutex
+	cached   string
+	cachedAt time.Time
+}
+
+// token returns the current token, re-reading it from disk once tokenRefreshInterval has passed
+func (rt *tokenRoundTripper) token() (string, error) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	if rt.cached != "" && time.Since(rt.cachedAt) < tokenRefreshInterval {
+		return rt.cached, nil
+	}
+
+	raw, err := os.ReadFile(rt.tokenFile)
+	if err != nil {
+		// Keep using the last known token if the file is briefly unavailable during rotation
+		if rt.cached != "" {
+			return rt.cached, nil
+		}
+		return "", err
+	}
+
+	rt.cached = string(bytes.TrimSpace(raw))
+	rt.cachedAt = time.Now()
+	return rt.cached, nil
+}
+
+func (rt *tokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := rt.token()
+	if err != nil {
+		return nil, err
+	}
+
+	// RoundTrippers must not modify the original request
+	req2 := new(http.Request)
+	*req2 = *req
+	req2.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		req2.Header[k] = v
+	}
+	req2.Header.Set("Authorization", "Bearer "+token)
+
+	return rt.next.RoundTrip(req2)
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport, so http.Client.CloseIdleConnections reaches it
+func (rt *tokenRoundTripper) CloseIdleConnections() {
+	if c, ok := rt.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,133 @@
+package kubecerthttp_test
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	kubecerthttp "github.com/PalmStoneGames/kube-cert-http"
+	"github.com/PalmStoneGames/kube-cert-http/kubefake"
+)
+
+// idleCounter is a transport counting the calls to CloseIdleConnections
+type idleCounter struct {
+	http.Transport
+	closed int
+}
+
+func (c *idleCounter) CloseIdleConnections() {
+	c.closed++
+	c.Transport.CloseIdleConnections()
+}
+
+func TestTokenRoundTripperClosesIdleConnections(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	next := &idleCounter{}
+	client := &http.Client{Transport: kubecerthttp.NewTokenRoundTripper(tokenFile, next)}
+
+	client.CloseIdleConnections()
+	if next.closed != 1 {
+		t.Errorf("CloseIdleConnections reached the wrapped transport %v times, want 1", next.closed)
+	}
+}
+
+func TestReconnectsDontLeakGoroutines(t *testing.T) {
+	crt, key := newCert(t, "a.example.com")
+	api := kubefake.NewServer(tlsSecret("a", "a.example.com", crt, key))
+	defer api.Close()
+
+	baseline := runtime.NumGoroutine()
+	m, err := kubecerthttp.NewMonitor(context.Background(), api.URL, "default",
+		kubecerthttp.WithHTTPClient(&http.Client{Transport: &http.Transport{}}),
+		kubecerthttp.WithReconnectBackoff(time.Millisecond, time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a.example.com to be served", func() bool { return serves(m, "a.example.com", crt) })
+
+	// Every closed watch is reconnected, the number of goroutines must not grow with the reconnects
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var running int
+	for i := 0; i < 50; i++ {
+		if err := api.WaitForWatch(ctx); err != nil {
+			t.Fatal(err)
+		}
+		api.CloseWatches()
+		if i == 9 {
+			running = runtime.NumGoroutine()
+		}
+	}
+	if err := api.WaitForWatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := runtime.NumGoroutine(); n > running+5 {
+		t.Errorf("Running %v goroutines after 50 reconnects, %v after 10", n, running)
+	}
+
+	// Stopping closes the connections of the client, along with their goroutines
+	m.Stop()
+	waitFor(t, "the goroutines to end", func() bool { return runtime.NumGoroutine() <= baseline+2 })
+}
+
+func TestInClusterPodNamespace(t *testing.T) {
+	crt, key := newCert(t, "a.example.com")
+	secret := tlsSecret("a", "a.example.com", crt, key)
+	secret.Namespace = "team-a"
+	api := kubefake.NewServer(secret)
+	defer api.Close()
+
+	// The API server is reached over TLS, and only answers requests carrying the service account token
+	target, err := url.Parse(api.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.FlushInterval = -1
+	front := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		proxy.ServeHTTP(rw, r)
+	}))
+	defer front.Close()
+
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"ca.crt":    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: front.Certificate().Raw}),
+		"token":     []byte("secret-token\n"),
+		"namespace": []byte("team-a\n"),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := kubecerthttp.NewInClusterMonitor(context.Background(), dir, front.URL, kubecerthttp.PodNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	waitFor(t, "a.example.com to be served", func() bool { return serves(m, "a.example.com", crt) })
+
+	// Without the namespace file, there's no pod namespace to use
+	if err := os.Remove(filepath.Join(dir, "namespace")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kubecerthttp.NewInClusterMonitor(context.Background(), dir, front.URL, kubecerthttp.PodNamespace); err == nil {
+		t.Error("Expected an error without a service account namespace")
+	}
+}
@@ -0,0 +1,100 @@
+package kubecerthttp
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// normalizePEMKey finds the private key in rawKey and returns it as a single PKCS#8 PRIVATE KEY block.
+// PKCS#1 RSA, SEC 1 EC and PKCS#8 keys are accepted regardless of the type of their block, and other blocks such as EC PARAMETERS or certificates are skipped.
+// When no key can be loaded, the error names the blocks that were found.
+func normalizePEMKey(rawKey []byte) ([]byte, error) {
+	var types []string
+	rest := rawKey
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		types = append(types, block.Type)
+		if !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			continue
+		}
+
+		if block.Headers["Proc-Type"] == "4,ENCRYPTED" {
+			return nil, fmt.Errorf("%v block uses legacy PEM encryption, which isn't supported, convert it to an encrypted PKCS#8 key", block.Type)
+		}
+		if block.Type == "ENCRYPTED PRIVATE KEY" {
+			return nil, errors.New("Private key is encrypted, but no passphrase is configured")
+		}
+
+		key, err := parsePrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse %v block: %v", block.Type, err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to use %v block: %v", block.Type, err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+
+	if len(types) == 0 {
+		return nil, errors.New("No PEM data found")
+	}
+	return nil, fmt.Errorf("No private key found, only %v blocks", strings.Join(types, ", "))
+}
+
+// derCertsToPEM converts DER encoded certificates to PEM, data that already contains PEM or doesn't parse as DER certificates is returned as is
+func derCertsToPEM(raw []byte) []byte {
+	if isPEM(raw) {
+		return raw
+	}
+
+	certs, err := x509.ParseCertificates(raw)
+	if err != nil || len(certs) == 0 {
+		return raw
+	}
+
+	var converted []byte
+	for _, cert := range certs {
+		converted = append(converted, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return converted
+}
+
+// derKeyToPEM converts a DER encoded private key to PEM, data that already contains PEM or doesn't parse as a DER private key is returned as is
+func derKeyToPEM(raw []byte) []byte {
+	if isPEM(raw) {
+		return raw
+	}
+
+	if _, err := parsePrivateKey(raw); err != nil {
+		return raw
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: raw})
+}
+
+// isPEM returns whether raw contains a PEM block
+func isPEM(raw []byte) bool {
+	block, _ := pem.Decode(raw)
+	return block != nil
+}
+
+// parsePrivateKey parses a DER encoded PKCS#1 RSA, PKCS#8 or SEC 1 EC private key
+func parsePrivateKey(der []byte) (interface{}, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("not a PKCS#1, PKCS#8 or EC private key")
+}
@@ -0,0 +1,365 @@
+// Package kubefake provides a fake kubernetes API server serving secrets, to test code using kubecerthttp without a cluster.
+// Pass the URL of the server as the apiHost, then script changes to the secrets through Send and Apply, e.g. to test reconnects, expired resource versions, deleted secrets and broken certificates.
+// Watches resume from the resource version they ask for, until the history is dropped through Compact.
+// Only getting, listing and watching secrets is supported, label and field selectors are ignored.
+package kubefake
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secret is a secret held by the fake API server
+type Secret struct {
+	Namespace   string
+	Name        string
+	Type        string // kubernetes.io/tls if empty
+	Labels      map[string]string
+	Annotations map[string]string
+	Data        map[string][]byte
+}
+
+// Event is a change sent to the watches of the fake API server
+type Event struct {
+	Type   string // ADDED, MODIFIED, DELETED, BOOKMARK or ERROR
+	Secret Secret // secret that changed, only its namespace is used for BOOKMARK and ERROR events
+
+	// Code and Reason are sent in the Status object of ERROR events, e.g. 410 and "Expired" for an expired resource version
+	Code   int
+	Reason string
+}
+
+// Server is a fake kubernetes API server, it embeds the httptest.Server it runs on
+type Server struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	version  int
+	secrets  map[string]*stored // namespace/name -> secret
+	watches  map[*watch]struct{}
+	watching chan struct{} // closed and replaced when a watch connects
+
+	// history holds the changes since the last compaction, so watches can resume from a resource version
+	history   []change
+	compacted int
+}
+
+// change is a line sent to the watches, ending in a newline, along with the resource version it brought the secrets to
+type change struct {
+	version   int
+	namespace string
+	line      []byte
+}
+
+// stored is a secret along with the metadata the API server keeps for it
+type stored struct {
+	Secret
+	version int
+	created time.Time
+}
+
+// watch is a watch request being served, lines sent on it are written to the client
+type watch struct {
+	namespace string
+	lines     chan []byte
+	done      chan struct{}
+}
+
+// NewServer starts a fake API server holding the given secrets, call Close when done with it
+func NewServer(secrets ...Secret) *Server {
+	s := &Server{
+		secrets:  make(map[string]*stored),
+		watches:  make(map[*watch]struct{}),
+		watching: make(chan struct{}),
+	}
+	for _, secret := range secrets {
+		s.store(secret)
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Close ends all watches and shuts down the server
+func (s *Server) Close() {
+	s.CloseWatches()
+	s.Server.CloseClientConnections()
+	s.Server.Close()
+}
+
+// Send applies the events to the secrets of the server, and sends them to the watches that are currently connected for the namespace of the secret.
+// Watches connecting later on get the events made after the resource version they resume from, use WaitForWatch to wait for the first watch.
+func (s *Server) Send(events ...Event) {
+	s.apply(events, true)
+}
+
+// Apply changes the secrets of the server like Send, but doesn't send the events to the watches that are currently connected, like changes a watch missed.
+// Watches resuming from an earlier resource version still get them, e.g. use it along with an ERROR event to make clients list the secrets again.
+func (s *Server) Apply(events ...Event) {
+	s.apply(events, false)
+}
+
+// apply applies the events to the secrets, and sends them to the connected watches if broadcast is set
+func (s *Server) apply(events []Event, broadcast bool) {
+	for _, event := range events {
+		s.mutex.Lock()
+		var obj interface{}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			obj = s.encode(s.store(event.Secret))
+		case "DELETED":
+			key := event.Secret.Namespace + "/" + event.Secret.Name
+			secret, ok := s.secrets[key]
+			if !ok {
+				secret = &stored{Secret: event.Secret, created: time.Now()}
+			}
+			delete(s.secrets, key)
+			s.version++
+			secret.version = s.version
+			obj = s.encode(secret)
+		case "BOOKMARK":
+			s.version++
+			obj = map[string]interface{}{"metadata": map[string]interface{}{"resourceVersion": strconv.Itoa(s.version)}}
+		case "ERROR":
+			obj = map[string]interface{}{"kind": "Status", "status": "Failure", "code": event.Code, "reason": event.Reason}
+		}
+
+		// Lines are shared by the watches, so the newline is added once here instead of by each of them
+		line, _ := json.Marshal(map[string]interface{}{"type": event.Type, "object": obj})
+		line = append(line, '\n')
+		if event.Type != "ERROR" {
+			s.history = append(s.history, change{s.version, event.Secret.Namespace, line})
+		}
+		if broadcast {
+			s.broadcast(event.Secret.Namespace, line)
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// SendRaw sends a line to the watches that are currently connected as is, e.g. to test how invalid JSON is handled.
+// It doesn't change the secrets of the server.
+func (s *Server) SendRaw(namespace string, line []byte) {
+	line = append(line[:len(line):len(line)], '\n')
+	s.mutex.Lock()
+	s.broadcast(namespace, line)
+	s.mutex.Unlock()
+}
+
+// CloseWatches ends the watches that are currently connected cleanly, like the API server does once their timeout passes
+func (s *Server) CloseWatches() {
+	s.mutex.Lock()
+	for w := range s.watches {
+		close(w.lines)
+		delete(s.watches, w)
+	}
+	s.mutex.Unlock()
+}
+
+// Compact drops the history of changes, like the API server does periodically.
+// Watches resuming from a resource version before the compaction are refused with 410 Gone afterwards, so the secrets have to be listed again.
+func (s *Server) Compact() {
+	s.mutex.Lock()
+	s.history = nil
+	s.compacted = s.version
+	s.mutex.Unlock()
+}
+
+// WaitForWatch waits until a watch is connected, or ctx is done, in which case its error is returned
+func (s *Server) WaitForWatch(ctx context.Context) error {
+	for {
+		s.mutex.Lock()
+		connected := len(s.watches) > 0
+		watching := s.watching
+		s.mutex.Unlock()
+
+		if connected {
+			return nil
+		}
+
+		select {
+		case <-watching:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// store adds or replaces a secret, the caller must hold s.mutex unless the server isn't running yet
+func (s *Server) store(secret Secret) *stored {
+	if secret.Type == "" {
+		secret.Type = "kubernetes.io/tls"
+	}
+
+	key := secret.Namespace + "/" + secret.Name
+	created := time.Now()
+	if prev, ok := s.secrets[key]; ok {
+		created = prev.created
+	}
+	s.version++
+	s.secrets[key] = &stored{Secret: secret, version: s.version, created: created}
+	return s.secrets[key]
+}
+
+// encode converts a secret to the JSON object the API server sends
+func (s *Server) encode(secret *stored) map[string]interface{} {
+	metadata := map[string]interface{}{
+		"name":              secret.Name,
+		"namespace":         secret.Namespace,
+		"resourceVersion":   strconv.Itoa(secret.version),
+		"creationTimestamp": secret.created.UTC().Format(time.RFC3339),
+	}
+	if secret.Labels != nil {
+		metadata["labels"] = secret.Labels
+	}
+	if secret.Annotations != nil {
+		metadata["annotations"] = secret.Annotations
+	}
+	return map[string]interface{}{"metadata": metadata, "type": secret.Type, "data": secret.Data}
+}
+
+// broadcast sends a line to the watches of namespace, the caller must hold s.mutex
+func (s *Server) broadcast(namespace string, line []byte) {
+	for w := range s.watches {
+		if w.namespace != "" && w.namespace != namespace {
+			continue
+		}
+		select {
+		case w.lines <- line:
+		case <-w.done:
+		}
+	}
+}
+
+// serveHTTP lists or watches the secrets of a namespace, or of all namespaces
+func (s *Server) serveHTTP(rw http.ResponseWriter, r *http.Request) {
+	var namespace, name string
+	switch path := strings.TrimSuffix(r.URL.Path, "/"); {
+	case path == "/api/v1/secrets":
+	case strings.HasPrefix(path, "/api/v1/namespaces/"):
+		parts := strings.Split(strings.TrimPrefix(path, "/api/v1/namespaces/"), "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[1] != "secrets" {
+			http.NotFound(rw, r)
+			return
+		}
+		namespace = parts[0]
+		if len(parts) == 3 {
+			name = parts[2]
+		}
+	default:
+		http.NotFound(rw, r)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if name != "" {
+		s.get(rw, namespace, name)
+		return
+	}
+	if r.URL.Query().Get("watch") != "true" {
+		s.list(rw, namespace)
+		return
+	}
+	s.watch(rw, r, namespace)
+}
+
+// get writes a single secret, or a 404 Status if it doesn't exist
+func (s *Server) get(rw http.ResponseWriter, namespace, name string) {
+	s.mutex.Lock()
+	secret, ok := s.secrets[namespace+"/"+name]
+	var obj map[string]interface{}
+	if ok {
+		obj = s.encode(secret)
+	}
+	s.mutex.Unlock()
+
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(map[string]interface{}{"kind": "Status", "status": "Failure", "reason": "NotFound", "code": http.StatusNotFound})
+		return
+	}
+	json.NewEncoder(rw).Encode(obj)
+}
+
+// list writes the secrets of namespace as a secret list
+func (s *Server) list(rw http.ResponseWriter, namespace string) {
+	s.mutex.Lock()
+	items := []interface{}{}
+	for _, secret := range s.secrets {
+		if namespace == "" || secret.Namespace == namespace {
+			items = append(items, s.encode(secret))
+		}
+	}
+	version := strconv.Itoa(s.version)
+	s.mutex.Unlock()
+
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"kind":     "SecretList",
+		"metadata": map[string]interface{}{"resourceVersion": version},
+		"items":    items,
+	})
+}
+
+// watch streams the lines sent to the watch until it is closed or the client goes away
+func (s *Server) watch(rw http.ResponseWriter, r *http.Request, namespace string) {
+	w := &watch{namespace: namespace, lines: make(chan []byte), done: make(chan struct{})}
+	rv := r.URL.Query().Get("resourceVersion")
+	version, _ := strconv.Atoi(rv)
+
+	s.mutex.Lock()
+	if rv != "" && version < s.compacted {
+		s.mutex.Unlock()
+		http.Error(rw, `{"kind":"Status","status":"Failure","reason":"Expired","code":410}`, http.StatusGone)
+		return
+	}
+
+	// Changes made after the resource version the watch resumes from are sent first, like the API server does
+	var replay [][]byte
+	for _, c := range s.history {
+		if rv != "" && c.version > version && (namespace == "" || c.namespace == namespace) {
+			replay = append(replay, c.line)
+		}
+	}
+	s.watches[w] = struct{}{}
+	close(s.watching)
+	s.watching = make(chan struct{})
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.watches, w)
+		s.mutex.Unlock()
+	}()
+	// Unblocks broadcasts to this watch before it is removed, as they hold the mutex
+	defer close(w.done)
+
+	rw.WriteHeader(http.StatusOK)
+	flusher, _ := rw.(http.Flusher)
+	for _, line := range replay {
+		rw.Write(line)
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case line, ok := <-w.lines:
+			if !ok {
+				return
+			}
+			rw.Write(line)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package kubefake_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/PalmStoneGames/kube-cert-http/kubefake"
+)
+
+// watchLine is a line of a watch response, with the parts the tests look at
+type watchLine struct {
+	Type   string
+	Object struct {
+		Code     int
+		Metadata struct {
+			Name            string
+			ResourceVersion string
+		}
+	}
+}
+
+func secret(name string) kubefake.Secret {
+	return kubefake.Secret{Namespace: "default", Name: name, Data: map[string][]byte{"tls.crt": []byte("crt")}}
+}
+
+// get requests path from the server, and fails the test unless the status code is code
+func get(t *testing.T, s *kubefake.Server, path string, code int) *http.Response {
+	t.Helper()
+	resp, err := http.Get(s.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != code {
+		resp.Body.Close()
+		t.Fatalf("GET %v returned %v, want %v", path, resp.StatusCode, code)
+	}
+	return resp
+}
+
+// readLines reads n lines from a watch response
+func readLines(t *testing.T, r *bufio.Reader, n int) []watchLine {
+	t.Helper()
+	lines := make([]watchLine, n)
+	for i := range lines {
+		data, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("Reading line %v: %v", i, err)
+		}
+		if err := json.Unmarshal(data, &lines[i]); err != nil {
+			t.Fatalf("Decoding line %q: %v", data, err)
+		}
+	}
+	return lines
+}
+
+func TestListAndGet(t *testing.T) {
+	s := kubefake.NewServer(secret("a"), secret("b"))
+	defer s.Close()
+
+	resp := get(t, s, "/api/v1/namespaces/default/secrets", http.StatusOK)
+	var list struct {
+		Metadata struct{ ResourceVersion string }
+		Items    []json.RawMessage
+	}
+	err := json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 2 || list.Metadata.ResourceVersion != "2" {
+		t.Fatalf("Listed %v secrets at resource version %q, want 2 at 2", len(list.Items), list.Metadata.ResourceVersion)
+	}
+
+	get(t, s, "/api/v1/namespaces/default/secrets/a", http.StatusOK).Body.Close()
+	get(t, s, "/api/v1/namespaces/default/secrets/c", http.StatusNotFound).Body.Close()
+	get(t, s, "/api/v1/namespaces/other/secrets/a", http.StatusNotFound).Body.Close()
+}
+
+func TestWatchReplaysHistory(t *testing.T) {
+	s := kubefake.NewServer()
+	defer s.Close()
+	s.Send(kubefake.Event{Type: "ADDED", Secret: secret("a")}, kubefake.Event{Type: "ADDED", Secret: secret("b")}, kubefake.Event{Type: "DELETED", Secret: secret("a")})
+
+	resp := get(t, s, "/api/v1/namespaces/default/secrets?watch=true&resourceVersion=1", http.StatusOK)
+	defer resp.Body.Close()
+	lines := readLines(t, bufio.NewReader(resp.Body), 2)
+	if lines[0].Type != "ADDED" || lines[0].Object.Metadata.Name != "b" || lines[1].Type != "DELETED" || lines[1].Object.Metadata.ResourceVersion != "3" {
+		t.Fatalf("Unexpected replay %+v", lines)
+	}
+}
+
+func TestWatchFromZeroReplaysEverything(t *testing.T) {
+	s := kubefake.NewServer()
+	defer s.Close()
+	s.Send(kubefake.Event{Type: "ADDED", Secret: secret("a")})
+
+	resp := get(t, s, "/api/v1/namespaces/default/secrets?watch=true&resourceVersion=0", http.StatusOK)
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	if lines := readLines(t, r, 1); lines[0].Object.Metadata.Name != "a" {
+		t.Fatalf("Unexpected replay %+v", lines)
+	}
+
+	// Later changes are streamed to the connected watch
+	s.Send(kubefake.Event{Type: "MODIFIED", Secret: secret("a")})
+	if lines := readLines(t, r, 1); lines[0].Type != "MODIFIED" || lines[0].Object.Metadata.ResourceVersion != "2" {
+		t.Fatalf("Unexpected event %+v", lines)
+	}
+}
+
+func TestCompactExpiresOlderVersions(t *testing.T) {
+	s := kubefake.NewServer()
+	defer s.Close()
+	s.Send(kubefake.Event{Type: "ADDED", Secret: secret("a")}, kubefake.Event{Type: "ADDED", Secret: secret("b")})
+	s.Compact()
+
+	resp := get(t, s, "/api/v1/namespaces/default/secrets?watch=true&resourceVersion=1", http.StatusGone)
+	var status struct {
+		Code   int
+		Reason string
+	}
+	err := json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Code != http.StatusGone || status.Reason != "Expired" {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+
+	// Relisting gives the version to watch from, which is still available
+	s.Send(kubefake.Event{Type: "ADDED", Secret: secret("c")})
+	resp = get(t, s, "/api/v1/namespaces/default/secrets?watch=true&resourceVersion=2", http.StatusOK)
+	defer resp.Body.Close()
+	if lines := readLines(t, bufio.NewReader(resp.Body), 1); lines[0].Object.Metadata.Name != "c" {
+		t.Fatalf("Unexpected replay %+v", lines)
+	}
+}
+
+func TestErrorEventAndCloseWatches(t *testing.T) {
+	s := kubefake.NewServer()
+	defer s.Close()
+
+	resp := get(t, s, "/api/v1/namespaces/default/secrets?watch=true", http.StatusOK)
+	defer resp.Body.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.WaitForWatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Send(kubefake.Event{Type: "ERROR", Secret: kubefake.Secret{Namespace: "default"}, Code: http.StatusGone, Reason: "Expired"})
+	r := bufio.NewReader(resp.Body)
+	if lines := readLines(t, r, 1); lines[0].Type != "ERROR" || lines[0].Object.Code != http.StatusGone {
+		t.Fatalf("Unexpected event %+v", lines)
+	}
+
+	s.CloseWatches()
+	if _, err := r.ReadBytes('\n'); err != io.EOF {
+		t.Fatalf("Reading after CloseWatches returned %v, want io.EOF", err)
+	}
+}
+
+func TestApplyIsOnlyReplayed(t *testing.T) {
+	s := kubefake.NewServer(secret("a"))
+	defer s.Close()
+
+	resp := get(t, s, "/api/v1/namespaces/default/secrets?watch=true&resourceVersion=1", http.StatusOK)
+	defer resp.Body.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.WaitForWatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connected watch misses the deletion, the next event shows it wasn't sent
+	s.Apply(kubefake.Event{Type: "DELETED", Secret: secret("a")})
+	s.Send(kubefake.Event{Type: "ADDED", Secret: secret("b")})
+	if lines := readLines(t, bufio.NewReader(resp.Body), 1); lines[0].Type != "ADDED" || lines[0].Object.Metadata.Name != "b" {
+		t.Fatalf("Unexpected event %+v", lines)
+	}
+	get(t, s, "/api/v1/namespaces/default/secrets/a", http.StatusNotFound).Body.Close()
+
+	// Watches resuming from before the deletion get it
+	replay := get(t, s, "/api/v1/namespaces/default/secrets?watch=true&resourceVersion=1", http.StatusOK)
+	defer replay.Body.Close()
+	if lines := readLines(t, bufio.NewReader(replay.Body), 2); lines[0].Type != "DELETED" || lines[1].Object.Metadata.Name != "b" {
+		t.Fatalf("Unexpected replay %+v", lines)
+	}
+}
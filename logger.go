@@ -0,0 +1,61 @@
+package kubecerthttp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// logger writes the log messages of a monitor, to the standard log package by default or to the slog.Logger set through WithLogger
+type logger struct {
+	slog *slog.Logger
+}
+
+// logf logs a message that isn't about a specific domain
+func (l logger) logf(level slog.Level, format string, args ...interface{}) {
+	if l.slog == nil {
+		log.Printf(format, args...)
+		return
+	}
+
+	l.slog.Log(context.Background(), level, fmt.Sprintf(format, args...))
+}
+
+// domainf logs a message about domain, which is prefixed to the message for the standard log package and added as an attribute for slog
+func (l logger) domainf(level slog.Level, domain string, format string, args ...interface{}) {
+	if l.slog == nil {
+		log.Printf("[%v] "+format, append([]interface{}{domain}, args...)...)
+		return
+	}
+
+	l.slog.Log(context.Background(), level, fmt.Sprintf(format, args...), "domain", domain)
+}
+
+// errorLimiter collapses repeated errors, so sustained failures like an unreachable API server don't flood the log
+type errorLimiter struct {
+	interval time.Duration
+
+	mutex      sync.Mutex
+	last       string    // message of the last error
+	lastLogged time.Time // when the last error was logged
+	repeated   int       // number of times the last error was suppressed since it was logged
+}
+
+// allow returns whether an error with the given message should be logged, and how many times the previously logged error was suppressed since.
+// An error is suppressed when it is the same as the previous one, and that was logged less than the interval ago.
+func (l *errorLimiter) allow(msg string, now time.Time) (bool, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if msg == l.last && now.Sub(l.lastLogged) < l.interval {
+		l.repeated++
+		return false, 0
+	}
+
+	repeated := l.repeated
+	l.last, l.lastLogged, l.repeated = msg, now, 0
+	return true, repeated
+}
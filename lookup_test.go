@@ -0,0 +1,124 @@
+package kubecerthttp_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"regexp"
+	"testing"
+
+	kubecerthttp "github.com/PalmStoneGames/kube-cert-http"
+	"github.com/PalmStoneGames/kube-cert-http/kubefake"
+)
+
+func TestWildcardMatching(t *testing.T) {
+	wildcardCrt, wildcardKey := newCert(t, "*.example.com")
+	exactCrt, exactKey := newCert(t, "api.example.com")
+	api := kubefake.NewServer(
+		tlsSecret("wildcard", "*.example.com", wildcardCrt, wildcardKey),
+		tlsSecret("exact", "api.example.com", exactCrt, exactKey),
+	)
+	defer api.Close()
+
+	m := startMonitor(t, api)
+	waitFor(t, "the certificates to be loaded", func() bool { return len(m.Domains()) == 2 })
+
+	for _, tt := range []struct {
+		serverName string
+		crt        []byte
+	}{
+		{"api.example.com", exactCrt},
+		{"www.example.com", wildcardCrt},
+	} {
+		if !serves(m, tt.serverName, tt.crt) {
+			t.Errorf("Wrong certificate served for %v", tt.serverName)
+		}
+	}
+
+	// Wildcards only cover a single label
+	for _, serverName := range []string{"example.com", "a.b.example.com"} {
+		if serves(m, serverName, wildcardCrt) {
+			t.Errorf("Wildcard certificate served for %v", serverName)
+		}
+	}
+}
+
+func TestCaseInsensitiveMatching(t *testing.T) {
+	crt, key := newCert(t, "api.example.com")
+	api := kubefake.NewServer(tlsSecret("api", "Api.Example.com", crt, key))
+	defer api.Close()
+
+	m := startMonitor(t, api)
+	waitFor(t, "api.example.com to be served", func() bool { return serves(m, "api.example.com", crt) })
+	if !serves(m, "API.Example.COM", crt) {
+		t.Error("Certificate not served for an upper case server name")
+	}
+}
+
+func TestSNIPortStripping(t *testing.T) {
+	crt, key := newCert(t, "example.com")
+	api := kubefake.NewServer(tlsSecret("a", "example.com", crt, key))
+	defer api.Close()
+
+	m := startMonitor(t, api)
+	waitFor(t, "example.com to be served", func() bool { return serves(m, "example.com", crt) })
+	if serves(m, "example.com:443", crt) {
+		t.Error("Certificate served for a server name with a port without WithSNIPortStripping")
+	}
+
+	m = startMonitor(t, api, kubecerthttp.WithSNIPortStripping())
+	waitFor(t, "example.com to be served", func() bool { return serves(m, "example.com", crt) })
+	if !serves(m, "example.com:443", crt) {
+		t.Error("Certificate not served for a server name with a port")
+	}
+}
+
+func TestEmptyServerName(t *testing.T) {
+	crtA, keyA := newCert(t, "a.example.com")
+	crtB, keyB := newCert(t, "b.example.com")
+	api := kubefake.NewServer(tlsSecret("a", "a.example.com", crtA, keyA))
+	defer api.Close()
+
+	// The only certificate loaded is served to clients without SNI
+	m := startMonitor(t, api)
+	waitFor(t, "a.example.com to be served", func() bool { return serves(m, "a.example.com", crtA) })
+	if !serves(m, "", crtA) {
+		t.Error("The only certificate isn't served without SNI")
+	}
+
+	// With more certificates, the default one is
+	defaultCrt, defaultKey := newCert(t, "default.example.com")
+	defaultCert, err := tls.X509KeyPair(defaultCrt, defaultKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("b", "b.example.com", crtB, keyB)})
+	m = startMonitor(t, api, kubecerthttp.WithDefaultCertificate(defaultCert))
+	waitFor(t, "b.example.com to be served", func() bool { return serves(m, "b.example.com", crtB) })
+	if !serves(m, "", defaultCrt) {
+		t.Error("The default certificate isn't served without SNI")
+	}
+}
+
+func TestHostPattern(t *testing.T) {
+	domains := []string{"a.internal.example.com", "internal.example.com", "a.internal.example.com.evil.com", "www.example.com", "other.example.org"}
+	var secrets []kubefake.Secret
+	crts := make(map[string][]byte)
+	for i, domain := range domains {
+		crt, key := newCert(t, domain)
+		crts[domain] = crt
+		secrets = append(secrets, tlsSecret(fmt.Sprint("s", i), domain, crt, key))
+	}
+	api := kubefake.NewServer(secrets...)
+	defer api.Close()
+
+	// The pattern must match the whole domain, hosts are served as well
+	m := startMonitor(t, api, kubecerthttp.WithHostPattern(regexp.MustCompile(`.*\.internal\.example\.com`)), kubecerthttp.WithHosts("www.example.com"))
+	waitFor(t, "the certificates to be loaded", func() bool { return len(m.Domains()) == 2 })
+
+	for _, domain := range domains {
+		want := domain == "a.internal.example.com" || domain == "www.example.com"
+		if got := serves(m, domain, crts[domain]); got != want {
+			t.Errorf("Serving %v is %v, want %v", domain, got, want)
+		}
+	}
+}
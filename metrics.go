@@ -0,0 +1,77 @@
+package kubecerthttp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// metrics holds the counters of a monitor that can't be derived from its cert map
+type metrics struct {
+	watchErrors    atomic.Uint64
+	stalledWatches atomic.Uint64
+	lastEvent      atomic.Int64 // unix timestamp
+
+	expiryWarnings atomic.Uint64
+	failedSecrets  atomic.Int64
+
+	domainsWithoutCert atomic.Uint64
+}
+
+// MetricsHandler returns a handler serving the metrics of the monitor in the Prometheus text format, so they can be scraped without any extra dependencies:
+//
+//	kubecerthttp_certs_loaded: number of domains a certificate is served for
+//	kubecerthttp_cert_not_after_seconds{domain}: expiry time of the preferred certificate served for each domain
+//	kubecerthttp_watch_errors_total: number of errors while watching the kubernetes secrets, including failed reconnects
+//	kubecerthttp_stalled_watches_total: number of watches restarted because nothing was received on them, see WithWatchIdleTimeout
+//	kubecerthttp_last_event_timestamp_seconds: time at which the last event was received from kubernetes
+//	kubecerthttp_expiry_warnings_total: number of certificates found to expire soon, see WithExpiryWarning
+//	kubecerthttp_failed_secrets: number of secrets whose certificate couldn't be loaded, these are retried periodically
+//	kubecerthttp_domains_without_cert_total: number of times deleting a secret left a domain without any certificate, as opposed to a rotation
+func (m *Monitor) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.writeMetrics(w)
+	})
+}
+
+func (m *Monitor) writeMetrics(w io.Writer) {
+	m.mutex.RLock()
+	notAfter := make(map[string]int64, len(m.certMap))
+	for domain, served := range m.certMap {
+		if leaf := served[0].Leaf; leaf != nil {
+			notAfter[domain] = leaf.NotAfter.Unix()
+		}
+	}
+	loaded := len(m.certMap)
+	m.mutex.RUnlock()
+
+	domains := make([]string, 0, len(notAfter))
+	for domain := range notAfter {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	writeMetric(w, "kubecerthttp_certs_loaded", "gauge", "Number of domains a certificate is served for.", int64(loaded))
+
+	fmt.Fprintf(w, "# HELP kubecerthttp_cert_not_after_seconds Expiry time of the certificate served for the domain.\n")
+	fmt.Fprintf(w, "# TYPE kubecerthttp_cert_not_after_seconds gauge\n")
+	for _, domain := range domains {
+		fmt.Fprintf(w, "kubecerthttp_cert_not_after_seconds{domain=%v} %d\n", strconv.Quote(domain), notAfter[domain])
+	}
+
+	writeMetric(w, "kubecerthttp_watch_errors_total", "counter", "Number of errors while watching the kubernetes secrets.", int64(m.metrics.watchErrors.Load()))
+	writeMetric(w, "kubecerthttp_stalled_watches_total", "counter", "Number of watches restarted because nothing was received on them.", int64(m.metrics.stalledWatches.Load()))
+	writeMetric(w, "kubecerthttp_last_event_timestamp_seconds", "gauge", "Time at which the last event was received from kubernetes.", m.metrics.lastEvent.Load())
+	writeMetric(w, "kubecerthttp_expiry_warnings_total", "counter", "Number of certificates found to expire soon.", int64(m.metrics.expiryWarnings.Load()))
+	writeMetric(w, "kubecerthttp_failed_secrets", "gauge", "Number of secrets whose certificate couldn't be loaded.", m.metrics.failedSecrets.Load())
+	writeMetric(w, "kubecerthttp_domains_without_cert_total", "counter", "Number of times deleting a secret left a domain without any certificate.", int64(m.metrics.domainsWithoutCert.Load()))
+}
+
+// writeMetric writes a metric without labels in the Prometheus text format
+func writeMetric(w io.Writer, name, typ, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v %d\n", name, help, name, typ, name, value)
+}
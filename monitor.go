@@ -0,0 +1,1128 @@
+package kubecerthttp
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errAlreadyStarted is returned by Run for monitors that were started or stopped before
+var errAlreadyStarted = errors.New("Monitor was already started")
+
+// errNotUnstarted is returned by Run for monitors that don't watch kubernetes, such as the ones created by NewFileMonitor
+var errNotUnstarted = errors.New("Run is only supported for monitors created by NewUnstartedMonitor")
+
+// errWatcherStarted is returned by Watcher.Start for watchers that were started or stopped before
+var errWatcherStarted = errors.New("Watcher was already started")
+
+// certEntry is a certificate loaded from a secret
+type certEntry struct {
+	secret  string    // namespace/name of the secret the certificate was loaded from
+	created time.Time // creation time of the secret, used to decide between secrets claiming the same domain
+	seen    time.Time // time at which a certificate was first loaded from the secret, kept across modifications
+	static  bool      // whether the certificate was passed to WithStaticCertificates, those are only served when no secret claims the domain
+	cert    *tls.Certificate
+
+	// ocspRefresh is when the OCSP staple of cert needs to be fetched again, the zero time if it was never fetched
+	ocspRefresh time.Time
+	// ocspExpires is the next update of the OCSP staple of cert, after which it must no longer be served, the zero time if unknown
+	ocspExpires time.Time
+}
+
+// Monitor watches the kubernetes secrets in one or more namespaces and keeps the certificates served by its TLS config up to date.
+// It runs in the background until Stop is called or the context it was created with is cancelled.
+type Monitor struct {
+	cfg     *config
+	tlsCfg  *tls.Config
+	log     logger
+	metrics metrics
+
+	// errLimiter keeps repeated watch errors from flooding the log
+	errLimiter errorLimiter
+
+	// Bookkeeping variables
+	certMap    map[string][]*tls.Certificate // domain -> certificates being served, one per key algorithm
+	preferred  map[string]*tls.Certificate   // domain -> first certificate in certMap, passed to the cert selector
+	candidates map[string][]*certEntry       // domain -> certificates of all secrets claiming it, in order of preference
+	secrets    map[string][]string           // namespace/name of a secret -> domains it claims
+	mutex      sync.RWMutex
+	hostMap    map[string]struct{} // hosts to serve certificates for, nil to serve all of them, guarded by handling
+	aliasMap   map[string]string   // alias -> domain whose certificate is served for it, guarded by mutex
+
+	// subscribers receive the changes to the served certificates, see Subscribe, guarded by mutex
+	subscribers []*subscription
+
+	// lookup is a copy of what handshakes need, replaced after every change so handshakes don't contend with the mutex
+	lookup atomic.Pointer[certLookup]
+
+	// defaultCert is served when nothing in certMap matches
+	defaultCert *tls.Certificate
+
+	// clientCAs holds the CAs in the client CA secret that client certificates must be signed by, it is nil until the secret is loaded
+	clientCAs *x509.CertPool
+	// clientCRL is the revocation list in the client CRL secret, it is nil until the secret is loaded
+	clientCRL *clientCRL
+	// tlsSettings replaces the settings of tlsCfg, see SetTLSSettings
+	tlsSettings *TLSSettings
+	// clientCfg is returned by GetConfigForClient to apply clientCAs and tlsSettings, it is nil when tlsCfg applies as is
+	clientCfg *tls.Config
+
+	// stapleTrigger wakes up the OCSP stapler, it is nil when stapling is disabled
+	stapleTrigger chan struct{}
+
+	// handling serializes handling events, so retries can't overtake newer events for the same secret
+	handling sync.Mutex
+	// failed holds the last event of each secret whose certificate couldn't be loaded, by namespace/name, it is guarded by handling
+	failed map[string]secretEvent
+	// latest holds the last event of each secret holding a certificate, so they can be evaluated again when the hosts change, it is guarded by handling
+	latest map[string]secretEvent
+	// skipped holds the secrets whose certificate expired, by namespace/name, see SkippedCerts, it is guarded by handling
+	skipped map[string]SkippedCert
+	// closed is set by Close, after which changes to the secrets and hosts are ignored, it is guarded by handling
+	closed bool
+
+	// ready is closed once certificates are served, see Ready
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	// watcher holds the sources of a monitor watching kubernetes, it is nil for other monitors
+	watcher *Watcher
+
+	// started is set once the monitor is started, or stopped before that, it is guarded by startMutex
+	startMutex sync.Mutex
+	started    bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	// stopping is closed once the monitor is being stopped, so subscribers that stopped receiving are skipped
+	stopping chan struct{}
+}
+
+// NewMonitor starts monitoring the kubernetes secrets and returns a handle to the monitor, use TLSConfig to get a TLS config serving the certificates.
+// apiHost is the endpoint at which we can connect to kubernetes, usually this is 127.0.0.1:8001 when using kubectl proxy, which is exposed in the constant ApiHostKubectlProxy.
+// The http scheme is assumed if apiHost has none, and trailing slashes are ignored.
+// namespace is the kubernetes namespace to use, to use the default namespace, use the DefaultNamespace constant, to use all namespaces, use the AllNamespaces constant
+// More namespaces can be watched using WithNamespaces, if multiple secrets claim the same domain, the most recently created one is served, see WithSelectionPolicy.
+// Cancelling ctx has the same effect as calling Stop.
+// An error is returned if the options are invalid, or the secrets endpoint can't be reached or refuses the request, in which case no monitor is started.
+func NewMonitor(ctx context.Context, apiHost, namespace string, opts ...Option) (*Monitor, error) {
+	cfg := newConfig(opts)
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	apiHost, err := normalizeAPIHost(apiHost)
+	if err != nil {
+		return nil, err
+	}
+
+	// The watcher has a source per namespace, all feeding into the same cert map
+	w := newWatcher(cfg, apiHost, namespace)
+
+	m := newMonitor(cfg)
+	m.watcher = w
+	if err := m.start(ctx, w.sources); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// NewUnstartedMonitor is like NewMonitor, but doesn't connect to kubernetes until Run is called, so the caller controls when monitoring starts and which goroutine it blocks.
+// The TLS config returned by TLSConfig can be used right away, it serves no certificates until they are loaded by Run.
+// An error is returned if the options are invalid.
+func NewUnstartedMonitor(apiHost, namespace string, opts ...Option) (*Monitor, error) {
+	cfg := newConfig(opts)
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	apiHost, err := normalizeAPIHost(apiHost)
+	if err != nil {
+		return nil, err
+	}
+
+	m := newMonitor(cfg)
+	m.watcher = newWatcher(cfg, apiHost, namespace)
+	return m, nil
+}
+
+// eventSource starts producing secret events until ctx is cancelled, at which point the events channel must be closed
+type eventSource func(ctx context.Context) (<-chan secretEvent, <-chan error, error)
+
+// newMonitor sets up a monitor without starting it
+func newMonitor(cfg *config) *Monitor {
+	m := &Monitor{
+		cfg:        cfg,
+		log:        logger{cfg.logger},
+		errLimiter: errorLimiter{interval: cfg.errorLogInterval},
+		certMap:    make(map[string][]*tls.Certificate),
+		preferred:  make(map[string]*tls.Certificate),
+		candidates: make(map[string][]*certEntry),
+		secrets:    make(map[string][]string),
+		failed:     make(map[string]secretEvent),
+		latest:     make(map[string]secretEvent),
+		skipped:    make(map[string]SkippedCert),
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+		stopping:   make(chan struct{}),
+
+		defaultCert: cfg.defaultCert,
+	}
+
+	m.hostMap = newHostMap(cfg.hosts)
+	m.aliasMap = newAliasMap(cfg.aliases)
+
+	// Static certificates are served until secrets claiming their domains are loaded
+	for domain, cert := range cfg.staticCerts {
+		cert := cert
+		if cert.Leaf == nil && len(cert.Certificate) > 0 {
+			cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+		}
+		domain = strings.ToLower(domain)
+		m.candidates[domain] = []*certEntry{{secret: "static", cert: &cert, static: true}}
+		m.setServed(domain, []*tls.Certificate{&cert})
+	}
+
+	m.publish()
+
+	m.tlsCfg = &tls.Config{
+		GetCertificate: m.getCertificate,
+		NextProtos:     cfg.nextProtos,
+		MinVersion:     cfg.minVersion,
+		CipherSuites:   cfg.cipherSuites,
+	}
+	m.tlsCfg.GetConfigForClient = m.getConfigForClient
+	if cfg.clientCRLSecret != "" {
+		m.tlsCfg.VerifyPeerCertificate = m.verifyPeerCertificate
+	}
+
+	return m
+}
+
+// start starts all the sources and the background routines, if any source fails to start everything is stopped again
+func (m *Monitor) start(ctx context.Context, sources []eventSource) error {
+	m.startMutex.Lock()
+	defer m.startMutex.Unlock()
+	if m.started {
+		return errAlreadyStarted
+	}
+	m.started = true
+
+	ctx, m.cancel = context.WithCancel(ctx)
+	context.AfterFunc(ctx, func() { close(m.stopping) })
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		events, errc, err := source(ctx)
+		if err != nil {
+			m.cancel()
+			wg.Wait()
+			if m.watcher != nil {
+				m.watcher.closeIdleConnections()
+			}
+			close(m.done)
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.run(events, errc)
+		}()
+	}
+
+	if m.cfg.ocspStapling {
+		m.stapleTrigger = make(chan struct{}, 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.runOCSPStapler(ctx)
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.runRetrier(ctx)
+	}()
+
+	if m.cfg.expiryWarning > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.runExpiryChecker(ctx)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		if m.watcher != nil {
+			m.watcher.closeIdleConnections()
+		}
+		close(m.done)
+	}()
+
+	return nil
+}
+
+// TLSConfig returns the TLS config serving the certificates found by the monitor.
+// By default, the tls.Config is configured to work with http/1.1 and http/2, see WithNextProtos.
+func (m *Monitor) TLSConfig() *tls.Config {
+	return m.tlsCfg
+}
+
+// Stop halts the monitor, closing the connection to kubernetes, and waits for it to exit.
+// Certificates loaded so far keep being served by the TLS config.
+func (m *Monitor) Stop() {
+	m.startMutex.Lock()
+	if !m.started {
+		// Nothing to wait for, and Run won't start the monitor anymore
+		m.started = true
+		m.cancel = func() {}
+		close(m.stopping)
+		close(m.done)
+	}
+	m.startMutex.Unlock()
+
+	m.cancel()
+	<-m.done
+}
+
+// Close stops the monitor like Stop, and returns once everything has stopped: the watches, the background routines, and the callbacks and subscribers being notified.
+// Changes that were being debounced are applied first, so the callbacks and metrics reflect the final state of the secrets. Certificates loaded so far keep being served,
+// but no callback fires after Close returns, as later calls to SetHosts are ignored and Refresh returns an error.
+// If ctx is done before everything has stopped, e.g. because a callback doesn't return, its error is returned and the monitor keeps stopping in the background.
+func (m *Monitor) Close(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		m.Stop()
+
+		// Waits for SetHosts and Refresh calls in progress
+		m.handling.Lock()
+		m.closed = true
+		m.handling.Unlock()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run starts monitoring the kubernetes secrets of a monitor created by NewUnstartedMonitor, and blocks until ctx is cancelled or Stop is called.
+// It returns ctx.Err() once ctx is cancelled, and nil after Stop. An error is returned right away if the secrets endpoint can't be reached or refuses the request,
+// if the monitor was already started or stopped, as a monitor can only be run once, or if it doesn't watch kubernetes, such as one created by NewFileMonitor.
+func (m *Monitor) Run(ctx context.Context) error {
+	if m.watcher == nil {
+		return errNotUnstarted
+	}
+	if err := m.start(ctx, m.watcher.sources); err != nil {
+		return err
+	}
+
+	<-m.done
+	return ctx.Err()
+}
+
+// ResourceVersions returns the resource version each namespace is currently watched from, like Watcher.ResourceVersions.
+// It returns nil for monitors that don't watch kubernetes, such as the ones created by NewFileMonitor.
+func (m *Monitor) ResourceVersions() map[string]string {
+	if m.watcher == nil {
+		return nil
+	}
+	return m.watcher.ResourceVersions()
+}
+
+// Domains returns the domains a certificate is currently loaded for, sorted alphabetically
+func (m *Monitor) Domains() []string {
+	m.mutex.RLock()
+	domains := make([]string, 0, len(m.certMap))
+	for domain := range m.certMap {
+		domains = append(domains, domain)
+	}
+	m.mutex.RUnlock()
+
+	sort.Strings(domains)
+	return domains
+}
+
+// Certificates returns a copy of the certificates currently loaded, by domain.
+// When a domain has certificates for multiple key algorithms, the preferred one is returned.
+// Changing the returned certificates doesn't affect what is being served.
+func (m *Monitor) Certificates() map[string]*tls.Certificate {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	certs := make(map[string]*tls.Certificate, len(m.certMap))
+	for domain, served := range m.certMap {
+		c := *served[0]
+		certs[domain] = &c
+	}
+	return certs
+}
+
+// Ready returns a channel that is closed once the monitor is ready to serve: when a certificate is loaded for every host passed to WithHosts, or for any domain if no hosts were given.
+// This can be used to gate readiness probes on the certificates being available. The channel stays closed, even if certificates are removed later on.
+// Until then, the hosts that are still missing a certificate are logged whenever a certificate is loaded.
+func (m *Monitor) Ready() <-chan struct{} {
+	return m.ready
+}
+
+// checkReady closes the ready channel if the monitor is ready to serve, the caller must hold m.handling
+func (m *Monitor) checkReady() {
+	m.mutex.RLock()
+	ready := len(m.certMap) > 0
+	var missing []string
+	for host := range m.hostMap {
+		if _, ok := m.certMap[host]; !ok {
+			ready = false
+			missing = append(missing, host)
+		}
+	}
+	m.mutex.RUnlock()
+
+	if ready {
+		m.readyOnce.Do(func() {
+			close(m.ready)
+		})
+		return
+	}
+
+	select {
+	case <-m.ready:
+	default:
+		if len(missing) == 0 {
+			return
+		}
+		sort.Strings(missing)
+		m.log.logf(slog.LevelInfo, "Not ready yet, no certificate loaded for hosts %v", strings.Join(missing, ", "))
+	}
+}
+
+// SetHosts replaces the hosts to fetch certificates for, if left empty all hosts for which certs can be found for will be used.
+// The secrets seen so far are evaluated again, so certificates for hosts that are no longer allowed are removed, and the ones for newly allowed hosts are loaded.
+func (m *Monitor) SetHosts(hosts ...string) {
+	m.handling.Lock()
+	defer m.handling.Unlock()
+	if m.closed {
+		return
+	}
+
+	m.hostMap = newHostMap(hosts)
+
+	keys := make([]string, 0, len(m.latest))
+	for key := range m.latest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		// Applied as additions, so secrets that keep serving the same domains aren't reported as modified
+		event := m.latest[key]
+		event.Type = "ADDED"
+		m.applyEvent(event)
+	}
+	m.checkReady()
+}
+
+// newHostMap converts hosts to a map for convenience, it returns nil if there are no hosts
+func newHostMap(hosts []string) map[string]struct{} {
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	hostMap := make(map[string]struct{})
+	for _, host := range hosts {
+		hostMap[strings.ToLower(host)] = struct{}{}
+	}
+	return hostMap
+}
+
+// hostAllowed returns whether certificates are served for domain, either because it is one of the hosts or because it matches the host pattern.
+// All domains are allowed when neither is set. The caller must hold m.handling.
+func (m *Monitor) hostAllowed(domain string) bool {
+	if m.hostMap == nil && m.cfg.hostPattern == nil {
+		return true
+	}
+	if _, ok := m.hostMap[domain]; ok {
+		return true
+	}
+	return m.cfg.hostPattern != nil && m.cfg.hostPattern.MatchString(domain)
+}
+
+// SetAliases replaces the aliases passed to WithAlias, mapping each domain to the extra names its certificate is served for.
+// The change applies to new handshakes right away.
+func (m *Monitor) SetAliases(aliases map[string][]string) {
+	aliasMap := newAliasMap(aliases)
+
+	m.mutex.Lock()
+	m.aliasMap = aliasMap
+	m.publish()
+	m.mutex.Unlock()
+}
+
+// newAliasMap inverts the aliases to map each alias to its domain, it returns nil if there are no aliases
+func newAliasMap(aliases map[string][]string) map[string]string {
+	if len(aliases) == 0 {
+		return nil
+	}
+
+	aliasMap := make(map[string]string)
+	for domain, names := range aliases {
+		for _, name := range names {
+			aliasMap[strings.ToLower(name)] = strings.ToLower(domain)
+		}
+	}
+	return aliasMap
+}
+
+// serverName returns the server name requested by the client the way certificates are looked up by
+func (m *Monitor) serverName(clientHello *tls.ClientHelloInfo) string {
+	// DNS names are case insensitive, the cert map only holds lower case names
+	name := strings.ToLower(clientHello.ServerName)
+	if m.cfg.stripSNIPort {
+		if host, _, err := net.SplitHostPort(name); err == nil {
+			name = host
+		}
+	}
+	return name
+}
+
+// getCertificate looks up the certificate for the requested server name.
+// Exact matches take precedence, then aliases are resolved to their domain, otherwise a wildcard certificate for the parent domain is used if there is one, and finally the default certificate.
+// Clients that don't send SNI get the default certificate, or the only certificate loaded if there is no default certificate.
+// When there are certificates with different key algorithms (e.g. RSA and ECDSA), the first one the client supports is used.
+func (m *Monitor) getCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := m.serverName(clientHello)
+
+	l := m.lookup.Load()
+	var cert *tls.Certificate
+	if m.cfg.certSelector != nil {
+		var err error
+		if cert, err = m.cfg.certSelector(clientHello, l.preferred); err != nil {
+			return nil, err
+		}
+	} else {
+		served, ok := l.certMap[name]
+		if domain, isAlias := l.aliasMap[name]; !ok && isAlias {
+			name = domain
+			served, ok = l.certMap[name]
+		}
+		switch {
+		case ok:
+		case name == "" && l.defaultCert == nil && len(l.certMap) == 1:
+			// Clients that don't send SNI get the only certificate there is, unless there's a default certificate
+			for _, only := range l.certMap {
+				served = only
+			}
+		default:
+			if i := strings.IndexByte(name, '.'); i > 0 {
+				served = l.certMap["*"+name[i:]]
+			}
+		}
+		cert = pickCert(clientHello, served)
+	}
+	if cert == nil {
+		cert = l.defaultCert
+	}
+
+	if cert == nil && m.cfg.errorOnMissingCert {
+		return nil, fmt.Errorf("No certificate for host %q", clientHello.ServerName)
+	}
+	return cert, nil
+}
+
+// run processes the events until the events channel is closed
+func (m *Monitor) run(events <-chan secretEvent, errc <-chan error) {
+	d := newDebouncer(m.cfg.debounce)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// Converge to the final state of the secrets before returning
+				for _, event := range d.flush(true) {
+					m.handleEvent(event)
+				}
+				return
+			}
+			m.metrics.lastEvent.Store(time.Now().Unix())
+			if event.Type == eventListed {
+				// The events of the list are handled before summarizing it
+				for _, event := range d.flush(true) {
+					m.handleEvent(event)
+				}
+				m.logSkipped()
+				continue
+			}
+			for _, event := range d.add(event) {
+				m.handleEvent(event)
+			}
+		case <-d.C():
+			for _, event := range d.flush(false) {
+				m.handleEvent(event)
+			}
+		case err := <-errc:
+			m.metrics.watchErrors.Add(1)
+			if err == errWatchStalled {
+				m.metrics.stalledWatches.Add(1)
+			}
+			if ok, repeated := m.errLimiter.allow(err.Error(), time.Now()); ok {
+				if repeated > 0 {
+					m.log.logf(slog.LevelError, "Previous error while monitoring kubernetes secrets repeated %d more times", repeated)
+				}
+				m.log.logf(slog.LevelError, "Error while monitoring kubernetes secrets for SSL certs: %v", err)
+			}
+		}
+	}
+}
+
+// handleEvent updates the served certificates according to a change to a secret
+func (m *Monitor) handleEvent(event secretEvent) {
+	m.handling.Lock()
+	defer m.handling.Unlock()
+	if m.closed {
+		return
+	}
+	m.applyEvent(event)
+}
+
+// applyEvent does the work of handleEvent, the caller must hold m.handling
+func (m *Monitor) applyEvent(event secretEvent) {
+	// Grab the secret name
+	secretName, ok := event.Object.Metadata["name"].(string)
+	if !ok {
+		m.log.logf(slog.LevelWarn, "Secret has no valid name") // Shouldn't happen
+		return
+	}
+	secretNamespace, _ := event.Object.Metadata["namespace"].(string)
+	secretKey := secretNamespace + "/" + secretName
+
+	// The client CA secret can be of any type
+	if matchesSecret(m.cfg.clientCASecret, secretName, secretKey) {
+		m.updateClientCAs(secretKey, event)
+	}
+	if matchesSecret(m.cfg.clientCRLSecret, secretName, secretKey) {
+		m.updateClientCRL(secretKey, event)
+	}
+
+	// Skip everything except TLS secrets
+	if !m.cfg.isCertSecret(event.Object.Type) {
+		return
+	}
+
+	if matchesSecret(m.cfg.defaultSecret, secretName, secretKey) {
+		m.updateDefaultCertificate(secretKey, event)
+
+		// The default secret doesn't need a domain
+		if event.Type != "DELETED" && len(m.secretDomains(&event.Object)) == 0 {
+			return
+		}
+	}
+
+	if event.Type == "DELETED" {
+		delete(m.latest, secretKey)
+	} else {
+		m.latest[secretKey] = event
+	}
+
+	// A new event supersedes the one that failed, it is added back below if it fails as well
+	m.setFailed(secretKey, nil)
+	delete(m.skipped, secretKey)
+
+	switch event.Type {
+	case "ADDED", "MODIFIED":
+		// Grab the domain names from the labels and/or certificate
+		domains := m.secretDomains(&event.Object)
+		if len(domains) == 0 {
+			m.log.logf(slog.LevelInfo, "Ignoring secret %v due to missing label '%v'", secretKey, m.cfg.domainLabel)
+			m.updateSecret(secretKey, nil, nil, false)
+			return
+		}
+
+		if m.hostMap != nil || m.cfg.hostPattern != nil {
+			allowed := domains[:0:0]
+			for _, domain := range domains {
+				if !m.hostAllowed(domain) {
+					m.log.domainf(slog.LevelInfo, domain, "Skipping domain")
+					continue
+				}
+				allowed = append(allowed, domain)
+			}
+			domains = allowed
+		}
+
+		var entry *certEntry
+		if len(domains) > 0 {
+			tlsCert, err := m.loadCert(domains[0], secretKey, &event.Object)
+			if err != nil {
+				// Secrets can be seen half written during renewals, e.g. with a new tls.crt and the old tls.key.
+				// The certificate loaded from the previous version of the secret keeps being served until the secret is valid again.
+				m.log.domainf(slog.LevelError, domains[0], "Error while parsing TLS cert: %v", err)
+				m.setFailed(secretKey, &event)
+				m.recordSkipped(secretKey, domains, &event.Object, err)
+				return
+			}
+
+			entry = &certEntry{secret: secretKey, cert: &tlsCert, seen: time.Now()}
+			if created, ok := event.Object.Metadata["creationTimestamp"].(string); ok {
+				entry.created, _ = time.Parse(time.RFC3339, created)
+			}
+		}
+
+		m.updateSecret(secretKey, domains, entry, event.Type == "MODIFIED")
+		if entry != nil {
+			m.triggerStapling()
+			m.checkReady()
+		}
+	case "DELETED":
+		// Unlike a rotation, nothing takes the place of these certificates, so handshakes for the domains fail from now on
+		for _, domain := range m.updateSecret(secretKey, nil, nil, false) {
+			m.metrics.domainsWithoutCert.Add(1)
+			m.log.domainf(slog.LevelError, domain, "Secret %v was deleted, no certificate is left for the domain", secretKey)
+		}
+	}
+}
+
+// matchesSecret returns whether a secret configured through an option by either its name or namespace/name refers to the given secret
+func matchesSecret(configured, secretName, secretKey string) bool {
+	return configured != "" && (configured == secretName || configured == secretKey)
+}
+
+// loadCert parses the certificate in the secret, and unless disabled through WithoutValidityCheck, checks that it is currently valid.
+// Intermediate certificates in ca.crt are added to the chain.
+// When it isn't, an error is returned so that the certificate currently being served is kept.
+func (m *Monitor) loadCert(domain string, secretName string, s *secret) (tls.Certificate, error) {
+	tlsCert, err := parseCert(m.cfg, domain, secretName, s)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if m.cfg.validityCheck {
+		if err := checkValidity(&tlsCert, time.Now()); err != nil {
+			return tls.Certificate{}, wrapError(ErrInvalidCertificate, "Kubernetes secret '%v' contains an invalid certificate: %v", secretName, err)
+		}
+	}
+
+	// Serve the full chain when the intermediates are stored separately
+	if rawCA, ok := s.Data["ca.crt"]; ok {
+		if err := appendChain(&tlsCert, rawCA); err != nil {
+			m.log.domainf(slog.LevelWarn, domain, "Not all certificates in ca.crt of secret %v are served: %v", secretName, err)
+		}
+	}
+
+	return tlsCert, nil
+}
+
+// updateDefaultCertificate makes the certificate in the default secret get served when nothing else matches.
+// When the secret is deleted, the certificate passed to WithDefaultCertificate is restored.
+func (m *Monitor) updateDefaultCertificate(secretName string, event secretEvent) {
+	var cert *tls.Certificate
+	switch event.Type {
+	case "ADDED", "MODIFIED":
+		tlsCert, err := m.loadCert("default", secretName, &event.Object)
+		if err != nil {
+			m.log.logf(slog.LevelError, "Error while parsing default TLS cert: %v", err)
+			return
+		}
+		cert = &tlsCert
+	case "DELETED":
+		cert = m.cfg.defaultCert
+	default:
+		return
+	}
+
+	m.mutex.Lock()
+	m.defaultCert = cert
+	m.publish()
+	m.mutex.Unlock()
+
+	m.log.logf(slog.LevelInfo, "Updated default certificate from secret %v", secretName)
+}
+
+// updateSecret makes the secret claim exactly the given domains with the certificate in entry.
+// Domains the secret previously claimed are released, and are served from other secrets claiming them if there are any.
+// The domains left without a certificate are returned.
+func (m *Monitor) updateSecret(secretKey string, domains []string, entry *certEntry, modified bool) []string {
+	var added, updated, removed []certChange
+	var conflicts []certConflict
+
+	m.mutex.Lock()
+	previous := make(map[string]*certEntry)
+	for _, domain := range m.secrets[secretKey] {
+		previous[domain] = m.candidates[domain][0]
+		for _, candidate := range m.candidates[domain] {
+			if candidate.secret == secretKey && entry != nil {
+				entry.seen = candidate.seen
+			}
+		}
+		m.candidates[domain] = withoutSecret(m.candidates[domain], secretKey)
+	}
+	for _, domain := range domains {
+		if _, ok := previous[domain]; !ok {
+			var prev *certEntry
+			if len(m.candidates[domain]) > 0 {
+				prev = m.candidates[domain][0]
+			}
+			previous[domain] = prev
+		}
+		m.candidates[domain] = append(withoutSecret(m.candidates[domain], secretKey), entry)
+	}
+
+	if len(domains) > 0 {
+		m.secrets[secretKey] = domains
+	} else {
+		delete(m.secrets, secretKey)
+	}
+
+	for domain, prev := range previous {
+		candidates := m.candidates[domain]
+		if len(candidates) == 0 {
+			delete(m.candidates, domain)
+			m.setServed(domain, nil)
+			if prev != nil {
+				removed = append(removed, certChange{domain, prev.cert})
+			}
+			continue
+		}
+
+		sortCandidates(m.cfg.selection, candidates)
+		served := servedCerts(candidates)
+		m.setServed(domain, served)
+
+		switch {
+		case prev == nil:
+			added = append(added, certChange{domain, candidates[0].cert})
+		case prev.secret != candidates[0].secret:
+			updated = append(updated, certChange{domain, candidates[0].cert})
+		case modified && entry != nil && isServed(served, entry.cert):
+			updated = append(updated, certChange{domain, entry.cert})
+		}
+
+		if entry != nil {
+			var claimed []*certEntry
+			var names []string
+			for _, candidate := range candidates {
+				if !candidate.static {
+					claimed = append(claimed, candidate)
+					names = append(names, candidate.secret)
+				}
+			}
+			if len(claimed) > len(servedCerts(claimed)) {
+				conflicts = append(conflicts, certConflict{domain, names})
+			}
+		}
+	}
+	m.publish()
+	m.mutex.Unlock()
+
+	for _, change := range added {
+		m.log.domainf(slog.LevelInfo, change.domain, "Added certificiate data (%v)", certSummary(change.cert))
+		m.warnUnpreferred(change.domain)
+		if m.cfg.onAdd != nil {
+			m.cfg.onAdd(change.domain, change.cert)
+		}
+		m.notify(CertEvent{Type: "ADDED", Domain: change.domain, Cert: change.cert})
+	}
+	for _, change := range updated {
+		m.log.domainf(slog.LevelInfo, change.domain, "Updated certificate data (%v)", certSummary(change.cert))
+		m.warnUnpreferred(change.domain)
+		if m.cfg.onModify != nil {
+			m.cfg.onModify(change.domain, change.cert)
+		}
+		m.notify(CertEvent{Type: "MODIFIED", Domain: change.domain, Cert: change.cert})
+	}
+	for _, change := range removed {
+		m.log.domainf(slog.LevelInfo, change.domain, "Removed certificate data")
+		if m.cfg.onDelete != nil {
+			m.cfg.onDelete(change.domain, change.cert)
+		}
+		m.notify(CertEvent{Type: "DELETED", Domain: change.domain, Cert: change.cert})
+	}
+	for _, conflict := range conflicts {
+		m.log.domainf(slog.LevelWarn, conflict.domain, "Domain is claimed by multiple secrets (%v), serving the certificate from %v", strings.Join(conflict.secrets, ", "), conflict.secrets[0])
+	}
+
+	orphaned := make([]string, len(removed))
+	for i, change := range removed {
+		orphaned[i] = change.domain
+	}
+	sort.Strings(orphaned)
+	return orphaned
+}
+
+// warnUnpreferred logs a warning if none of the certificates served for domain uses the key algorithm set through WithPreferredKeyAlgorithm
+func (m *Monitor) warnUnpreferred(domain string) {
+	algorithm := m.cfg.preferredKeyAlgorithm
+	if algorithm == x509.UnknownPublicKeyAlgorithm {
+		return
+	}
+
+	// The preferred certificate uses the algorithm if any of the served ones does
+	cert, ok := m.lookup.Load().preferred[domain]
+	if ok && keyAlgorithm(cert) != algorithm {
+		m.log.domainf(slog.LevelWarn, domain, "No %v certificate is available, serving %v instead", algorithm, keyAlgorithm(cert))
+	}
+}
+
+// certSummary describes a certificate in log messages by the SHA-256 fingerprint of its leaf and its expiry, to tell which certificate is being served
+func certSummary(cert *tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return "no certificate"
+	}
+
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+	summary := "sha256 " + hex.EncodeToString(fingerprint[:])
+	if cert.Leaf != nil {
+		summary += ", expires " + cert.Leaf.NotAfter.UTC().Format(time.RFC3339)
+	}
+	return summary
+}
+
+// certChange is a change to the certificate served for a domain
+type certChange struct {
+	domain string
+	cert   *tls.Certificate
+}
+
+// certConflict is a domain claimed by multiple secrets, the first of which is served
+type certConflict struct {
+	domain  string
+	secrets []string
+}
+
+// withoutSecret returns candidates without the entry loaded from secretKey
+func withoutSecret(candidates []*certEntry, secretKey string) []*certEntry {
+	filtered := candidates[:0:0]
+	for _, candidate := range candidates {
+		if candidate.secret != secretKey {
+			filtered = append(filtered, candidate)
+		}
+	}
+	return filtered
+}
+
+// certLookup is a snapshot of the certificates being served, it must not be modified once published
+type certLookup struct {
+	certMap     map[string][]*tls.Certificate
+	preferred   map[string]*tls.Certificate
+	aliasMap    map[string]string
+	defaultCert *tls.Certificate
+	clientCAs   *x509.CertPool
+	clientCRL   *clientCRL
+	clientCfg   *tls.Config
+}
+
+// publish replaces the snapshot used during handshakes with a copy of the current state, the caller must hold m.mutex for writing
+func (m *Monitor) publish() {
+	l := &certLookup{
+		certMap:     make(map[string][]*tls.Certificate, len(m.certMap)),
+		preferred:   make(map[string]*tls.Certificate, len(m.preferred)),
+		aliasMap:    m.aliasMap, // replaced as a whole, never modified
+		defaultCert: m.defaultCert,
+		clientCAs:   m.clientCAs,
+		clientCRL:   m.clientCRL,
+		clientCfg:   m.clientCfg,
+	}
+	for domain, served := range m.certMap {
+		l.certMap[domain] = served
+	}
+	for domain, cert := range m.preferred {
+		l.preferred[domain] = cert
+	}
+	m.lookup.Store(l)
+}
+
+// setServed sets the certificates served for a domain, or stops serving the domain if there are none. The caller must hold m.mutex.
+// The certificates using the key algorithm set through WithPreferredKeyAlgorithm are moved to the front, so they are offered first.
+func (m *Monitor) setServed(domain string, served []*tls.Certificate) {
+	if len(served) == 0 {
+		delete(m.certMap, domain)
+		delete(m.preferred, domain)
+		return
+	}
+	if algorithm := m.cfg.preferredKeyAlgorithm; algorithm != x509.UnknownPublicKeyAlgorithm && len(served) > 1 {
+		sorted := make([]*tls.Certificate, 0, len(served))
+		for _, cert := range served {
+			if keyAlgorithm(cert) == algorithm {
+				sorted = append(sorted, cert)
+			}
+		}
+		for _, cert := range served {
+			if keyAlgorithm(cert) != algorithm {
+				sorted = append(sorted, cert)
+			}
+		}
+		served = sorted
+	}
+	m.certMap[domain] = served
+	m.preferred[domain] = served[0]
+}
+
+// servedCerts returns the certificates to serve out of the sorted candidates: the first one for every key algorithm
+func servedCerts(candidates []*certEntry) []*tls.Certificate {
+	var served []*tls.Certificate
+	seen := make(map[x509.PublicKeyAlgorithm]struct{})
+	for _, candidate := range candidates {
+		algorithm := keyAlgorithm(candidate.cert)
+		if _, ok := seen[algorithm]; ok {
+			continue
+		}
+		seen[algorithm] = struct{}{}
+		served = append(served, candidate.cert)
+	}
+	return served
+}
+
+// keyAlgorithm returns the public key algorithm of the leaf of cert, or x509.UnknownPublicKeyAlgorithm if it wasn't parsed
+func keyAlgorithm(cert *tls.Certificate) x509.PublicKeyAlgorithm {
+	if cert.Leaf == nil {
+		return x509.UnknownPublicKeyAlgorithm
+	}
+	return cert.Leaf.PublicKeyAlgorithm
+}
+
+// isServed reports whether cert is one of the served certificates
+func isServed(served []*tls.Certificate, cert *tls.Certificate) bool {
+	for _, c := range served {
+		if c == cert {
+			return true
+		}
+	}
+	return false
+}
+
+// pickCert returns the first of the served certificates that the client supports, or the first one if it supports none of them
+func pickCert(clientHello *tls.ClientHelloInfo, served []*tls.Certificate) *tls.Certificate {
+	if len(served) == 0 {
+		return nil
+	}
+	if len(served) > 1 {
+		for _, cert := range served {
+			if clientHello.SupportsCertificate(cert) == nil {
+				return cert
+			}
+		}
+	}
+	return served[0]
+}
+
+// sortCandidates orders the candidates so the one to serve according to the selection policy comes first, static certificates always come last.
+// Ties are broken by serving the most recently created secret, or the first by name if they were created at the same time.
+func sortCandidates(policy SelectionPolicy, candidates []*certEntry) {
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		switch {
+		case a.static != b.static:
+			return b.static
+		case policy == SelectLatestNotBefore && !a.cert.Leaf.NotBefore.Equal(b.cert.Leaf.NotBefore):
+			return a.cert.Leaf.NotBefore.After(b.cert.Leaf.NotBefore)
+		case policy == SelectLongestValidity && !a.cert.Leaf.NotAfter.Equal(b.cert.Leaf.NotAfter):
+			return a.cert.Leaf.NotAfter.After(b.cert.Leaf.NotAfter)
+		case policy == SelectFirstSeen && !a.seen.Equal(b.seen):
+			return a.seen.Before(b.seen)
+		}
+
+		if !a.created.Equal(b.created) {
+			return a.created.After(b.created)
+		}
+		return a.secret < b.secret
+	})
+}
+
+// secretDomains returns all the domains the certificate in the secret should be served for, in lower case
+func (m *Monitor) secretDomains(s *secret) []string {
+	var domains []string
+	seen := make(map[string]struct{})
+	add := func(domain string) {
+		domain = strings.ToLower(domain)
+		if _, ok := seen[domain]; !ok {
+			seen[domain] = struct{}{}
+			domains = append(domains, domain)
+		}
+	}
+
+	if domain, ok := m.secretDomain(s); ok {
+		add(domain)
+	}
+
+	for _, name := range m.extraNames(s) {
+		add(name)
+	}
+
+	if m.cfg.sanDomains {
+		if leaf, err := leafCertificate(m.cfg, s); err == nil {
+			for _, name := range leaf.DNSNames {
+				add(name)
+			}
+		}
+	}
+
+	return domains
+}
+
+// extraNames returns the additional names listed in the label or annotation set through WithExtraNamesLabel
+func (m *Monitor) extraNames(s *secret) []string {
+	if m.cfg.extraNamesKey == "" {
+		return nil
+	}
+
+	var names []string
+	for _, field := range []string{"labels", "annotations"} {
+		values, _ := s.Metadata[field].(map[string]interface{})
+		list, ok := values[m.cfg.extraNamesKey].(string)
+		if !ok {
+			continue
+		}
+		for _, name := range strings.Split(list, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		break
+	}
+	return names
+}
+
+// secretDomain returns the domain the secret holds the certificate for.
+// It is read from the domain label, falling back to an annotation with the same key and, if enabled, the secret name and the certificate itself.
+func (m *Monitor) secretDomain(s *secret) (string, bool) {
+	for _, field := range []string{"labels", "annotations"} {
+		values, _ := s.Metadata[field].(map[string]interface{})
+		if domain, ok := values[m.cfg.domainLabel].(string); ok {
+			return domain, true
+		}
+	}
+
+	if m.cfg.domainFromName != nil {
+		name, _ := s.Metadata["name"].(string)
+		if domain := m.cfg.domainFromName(name); domain != "" {
+			return domain, true
+		}
+	}
+
+	if m.cfg.domainFromCert {
+		leaf, err := leafCertificate(m.cfg, s)
+		if err != nil {
+			return "", false
+		}
+		if len(leaf.DNSNames) > 0 {
+			return leaf.DNSNames[0], true
+		}
+		if leaf.Subject.CommonName != "" {
+			return leaf.Subject.CommonName, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,56 @@
+package kubecerthttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSortCandidates(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	// Secrets claiming the same domain: old was created first but holds the most recently issued certificate,
+	// long holds the one expiring last, and was loaded first. new and twin were created at the same time.
+	entry := func(secret string, created, seen, notBefore, notAfter time.Time) *certEntry {
+		return &certEntry{secret: secret, created: created, seen: seen, cert: &tls.Certificate{Leaf: &x509.Certificate{NotBefore: notBefore, NotAfter: notAfter}}}
+	}
+	entries := []*certEntry{
+		entry("default/old", base, base.Add(time.Minute), base.Add(5*day), base.Add(90*day)),
+		entry("default/long", base.Add(day), base, base.Add(day), base.Add(365*day)),
+		entry("default/new", base.Add(2*day), base.Add(2*time.Minute), base.Add(2*day), base.Add(92*day)),
+		entry("default/twin", base.Add(2*day), base.Add(3*time.Minute), base.Add(2*day), base.Add(92*day)),
+		{secret: "static", static: true, cert: &tls.Certificate{Leaf: &x509.Certificate{NotBefore: base.Add(10 * day), NotAfter: base.Add(1000 * day)}}},
+	}
+
+	for _, tt := range []struct {
+		name   string
+		policy SelectionPolicy
+		want   []string
+	}{
+		{"newest secret", SelectNewestSecret, []string{"default/new", "default/twin", "default/long", "default/old", "static"}},
+		{"latest not before", SelectLatestNotBefore, []string{"default/old", "default/new", "default/twin", "default/long", "static"}},
+		{"longest validity", SelectLongestValidity, []string{"default/long", "default/new", "default/twin", "default/old", "static"}},
+		{"first seen", SelectFirstSeen, []string{"default/long", "default/old", "default/new", "default/twin", "static"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// The order the secrets were loaded in doesn't matter
+			for i := 0; i < 10; i++ {
+				candidates := append([]*certEntry(nil), entries...)
+				rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+				sortCandidates(tt.policy, candidates)
+
+				var got []string
+				for _, c := range candidates {
+					got = append(got, c.secret)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("Sorted to %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
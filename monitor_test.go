@@ -0,0 +1,320 @@
+package kubecerthttp_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kubecerthttp "github.com/PalmStoneGames/kube-cert-http"
+	"github.com/PalmStoneGames/kube-cert-http/kubefake"
+)
+
+// expiredRecorder returns an option recording whether the monitor reported an expired resource version
+func expiredRecorder() (kubecerthttp.Option, *atomic.Bool) {
+	var expired atomic.Bool
+	return kubecerthttp.WithConnectionStateCallback(func(state kubecerthttp.WatchState, err error) {
+		if err != nil && strings.Contains(err.Error(), "expired") {
+			expired.Store(true)
+		}
+	}), &expired
+}
+
+func TestMonitorRecoversFromCompaction(t *testing.T) {
+	crtA, keyA := newCert(t, "a.example.com")
+	crtB, keyB := newCert(t, "b.example.com")
+	api := kubefake.NewServer(tlsSecret("a", "a.example.com", crtA, keyA))
+	defer api.Close()
+
+	recorder, expired := expiredRecorder()
+	m := startMonitor(t, api, recorder, kubecerthttp.WithReconnectBackoff(200*time.Millisecond, 200*time.Millisecond))
+	waitFor(t, "a.example.com to be served", func() bool { return serves(m, "a.example.com", crtA) })
+
+	// While the monitor waits to reconnect, the changes it missed are compacted, so resuming gets 410 Gone and the secrets have to be listed again
+	api.CloseWatches()
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("b", "b.example.com", crtB, keyB)})
+	api.Send(kubefake.Event{Type: "DELETED", Secret: tlsSecret("a", "a.example.com", crtA, keyA)})
+	api.Compact()
+
+	waitFor(t, "b.example.com to be served", func() bool { return serves(m, "b.example.com", crtB) })
+	waitFor(t, "a.example.com to be removed", func() bool { return !serves(m, "a.example.com", crtA) })
+	if !expired.Load() {
+		t.Error("The resource version wasn't reported as expired")
+	}
+}
+
+func TestMonitorHandlesErrorEvents(t *testing.T) {
+	crtA, keyA := newCert(t, "a.example.com")
+	crtB, keyB := newCert(t, "b.example.com")
+	api := kubefake.NewServer()
+	defer api.Close()
+
+	var statusCode atomic.Int64
+	var expired atomic.Bool
+	m := startMonitor(t, api, kubecerthttp.WithConnectionStateCallback(func(state kubecerthttp.WatchState, err error) {
+		var statusErr *kubecerthttp.StatusError
+		if errors.As(err, &statusErr) {
+			statusCode.Store(int64(statusErr.Code))
+		}
+		if err != nil && strings.Contains(err.Error(), "expired") {
+			expired.Store(true)
+		}
+	}))
+
+	// Other errors end the watch, which resumes where it left off
+	api.Send(kubefake.Event{Type: "ERROR", Secret: kubefake.Secret{Namespace: "default"}, Code: http.StatusInternalServerError, Reason: "InternalError"})
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("a", "a.example.com", crtA, keyA)})
+	waitFor(t, "a.example.com to be served", func() bool { return serves(m, "a.example.com", crtA) })
+	if code := statusCode.Load(); code != http.StatusInternalServerError {
+		t.Errorf("Reported status code %v, want 500", code)
+	}
+
+	// An expired resource version makes the secrets get listed again
+	api.Send(kubefake.Event{Type: "ERROR", Secret: kubefake.Secret{Namespace: "default"}, Code: http.StatusGone, Reason: "Expired"})
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("b", "b.example.com", crtB, keyB)})
+	waitFor(t, "b.example.com to be served", func() bool { return serves(m, "b.example.com", crtB) })
+	if !expired.Load() {
+		t.Error("The resource version wasn't reported as expired")
+	}
+	if !serves(m, "a.example.com", crtA) {
+		t.Error("a.example.com is no longer served after listing the secrets again")
+	}
+}
+
+func TestBadModifyKeepsServedCertificate(t *testing.T) {
+	crt, key := newCert(t, "a.example.com")
+	renewedCrt, renewedKey := newCert(t, "a.example.com")
+	barrierCrt, barrierKey := newCert(t, "b.example.com")
+	api := kubefake.NewServer(tlsSecret("a", "a.example.com", crt, key))
+	defer api.Close()
+
+	m := startMonitor(t, api)
+	waitFor(t, "a.example.com to be served", func() bool { return serves(m, "a.example.com", crt) })
+
+	// The renewed certificate was written before its key, so they don't match
+	api.Send(kubefake.Event{Type: "MODIFIED", Secret: tlsSecret("a", "a.example.com", renewedCrt, key)})
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("b", "b.example.com", barrierCrt, barrierKey)})
+	waitFor(t, "b.example.com to be served", func() bool { return serves(m, "b.example.com", barrierCrt) })
+	if !serves(m, "a.example.com", crt) {
+		t.Fatal("The previous certificate is no longer served after a broken update")
+	}
+
+	api.Send(kubefake.Event{Type: "MODIFIED", Secret: tlsSecret("a", "a.example.com", renewedCrt, renewedKey)})
+	waitFor(t, "the renewed certificate to be served", func() bool { return serves(m, "a.example.com", renewedCrt) })
+}
+
+func TestWatchSkipsBlankLines(t *testing.T) {
+	crt, key := newCert(t, "a.example.com")
+	api := kubefake.NewServer()
+	defer api.Close()
+
+	var disconnects atomic.Int64
+	m := startMonitor(t, api, kubecerthttp.WithConnectionStateCallback(func(state kubecerthttp.WatchState, err error) {
+		if state == kubecerthttp.WatchDisconnected {
+			disconnects.Add(1)
+		}
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := api.WaitForWatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Proxies may send whitespace and empty objects to keep the connection alive
+	for _, line := range []string{"", "  ", "\r", "{}", "null", "\t{}  "} {
+		api.SendRaw("default", []byte(line))
+	}
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("a", "a.example.com", crt, key)})
+	waitFor(t, "a.example.com to be served", func() bool { return serves(m, "a.example.com", crt) })
+	if n := disconnects.Load(); n != 0 {
+		t.Errorf("The watch was restarted %v times", n)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	files, err := kubecerthttp.NewFileMonitor(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer files.Stop()
+	if err := files.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "NewUnstartedMonitor") {
+		t.Errorf("Run on a file monitor returned %v", err)
+	}
+
+	api := kubefake.NewServer()
+	defer api.Close()
+	m := startMonitor(t, api)
+	if err := m.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "already started") {
+		t.Errorf("Run on a started monitor returned %v", err)
+	}
+}
+
+func TestRelabelShadowedSecretOutOfHosts(t *testing.T) {
+	crtA, keyA := newCert(t, "a.example.com")
+	crtB, keyB := newCert(t, "a.example.com")
+	barrierCrt, barrierKey := newCert(t, "c.example.com")
+	api := kubefake.NewServer(tlsSecret("a", "a.example.com", crtA, keyA))
+	defer api.Close()
+
+	m := startMonitor(t, api, kubecerthttp.WithHosts("a.example.com", "c.example.com"))
+	waitFor(t, "a.example.com to be served", func() bool { return serves(m, "a.example.com", crtA) })
+
+	// b is added later, so a stays the preferred secret for the domain
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("b", "a.example.com", crtB, keyB)})
+
+	// Relabeling b to a domain that isn't served drops all of its domains while a keeps serving
+	api.Send(kubefake.Event{Type: "MODIFIED", Secret: tlsSecret("b", "z.example.com", crtB, keyB)})
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("c", "c.example.com", barrierCrt, barrierKey)})
+	waitFor(t, "c.example.com to be served", func() bool { return serves(m, "c.example.com", barrierCrt) })
+	if !serves(m, "a.example.com", crtA) {
+		t.Error("a.example.com is no longer served from secret a")
+	}
+}
+
+func TestDebounceCoalescesModifications(t *testing.T) {
+	crt, key := newCert(t, "a.example.com")
+	api := kubefake.NewServer(tlsSecret("a", "a.example.com", crt, key))
+	defer api.Close()
+
+	var modified atomic.Int64
+	m := startMonitor(t, api, kubecerthttp.WithDebounce(200*time.Millisecond), kubecerthttp.WithOnModify(func(domain string, cert *tls.Certificate) {
+		modified.Add(1)
+	}))
+	waitFor(t, "a.example.com to be served", func() bool { return serves(m, "a.example.com", crt) })
+	events := make(chan kubecerthttp.CertEvent, 16)
+	defer m.Subscribe(events)()
+
+	// A burst of renewals only loads the last one
+	for i := 0; i < 5; i++ {
+		crt, key = newCert(t, "a.example.com")
+		api.Send(kubefake.Event{Type: "MODIFIED", Secret: tlsSecret("a", "a.example.com", crt, key)})
+	}
+	waitFor(t, "the last renewal to be served", func() bool { return serves(m, "a.example.com", crt) })
+
+	// Give leftovers of the burst the time to show up
+	time.Sleep(400 * time.Millisecond)
+	if n := modified.Load(); n != 1 {
+		t.Errorf("The certificate was replaced %v times, want once", n)
+	}
+	if n := len(events); n != 1 {
+		t.Fatalf("Subscriber received %v events, want one", n)
+	}
+	if event := <-events; event.Type != "MODIFIED" || event.Domain != "a.example.com" {
+		t.Errorf("Subscriber received %+v, want a.example.com to be modified", event)
+	}
+}
+
+func TestExpiredErrorEventDropsSecretsDeletedMeanwhile(t *testing.T) {
+	crtA, keyA := newCert(t, "a.example.com")
+	crtB, keyB := newCert(t, "b.example.com")
+	api := kubefake.NewServer(tlsSecret("a", "a.example.com", crtA, keyA), tlsSecret("b", "b.example.com", crtB, keyB))
+	defer api.Close()
+
+	recorder, expired := expiredRecorder()
+	m := startMonitor(t, api, recorder)
+	waitFor(t, "a.example.com to be served", func() bool { return serves(m, "a.example.com", crtA) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := api.WaitForWatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The watch misses the deletion of a, then the API server reports its resource version as expired
+	api.Apply(kubefake.Event{Type: "DELETED", Secret: tlsSecret("a", "a.example.com", crtA, keyA)})
+	api.Compact()
+	api.Send(kubefake.Event{Type: "ERROR", Secret: kubefake.Secret{Namespace: "default"}, Code: http.StatusGone, Reason: "Expired"})
+
+	waitFor(t, "a.example.com to be removed", func() bool { return !serves(m, "a.example.com", crtA) })
+	if !serves(m, "b.example.com", crtB) {
+		t.Error("b.example.com is no longer served after listing the secrets again")
+	}
+	if !expired.Load() {
+		t.Error("The resource version wasn't reported as expired")
+	}
+}
+
+func TestRefreshLoadsChangesTheWatchMissed(t *testing.T) {
+	crt, key := newCert(t, "a.example.com")
+	renewedCrt, renewedKey := newCert(t, "a.example.com")
+	api := kubefake.NewServer(tlsSecret("a", "a.example.com", crt, key))
+	defer api.Close()
+
+	m := startMonitor(t, api)
+	waitFor(t, "a.example.com to be served", func() bool { return serves(m, "a.example.com", crt) })
+
+	// The secret is rotated without the watch hearing about it
+	api.Apply(kubefake.Event{Type: "MODIFIED", Secret: tlsSecret("a", "a.example.com", renewedCrt, renewedKey)})
+	if err := m.Refresh("A.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if !serves(m, "a.example.com", renewedCrt) {
+		t.Error("The renewed certificate isn't served after Refresh")
+	}
+
+	// Errors keep the certificate being served
+	if err := m.Refresh("b.example.com"); err == nil || !strings.Contains(err.Error(), "No secret found") {
+		t.Errorf("Refreshing an unknown domain returned %v", err)
+	}
+	api.Apply(kubefake.Event{Type: "DELETED", Secret: tlsSecret("a", "a.example.com", nil, nil)})
+	if err := m.Refresh("a.example.com"); err == nil || !strings.Contains(err.Error(), "no longer exists") {
+		t.Errorf("Refreshing a deleted secret returned %v", err)
+	}
+	if !serves(m, "a.example.com", renewedCrt) {
+		t.Error("The certificate is no longer served after a failed Refresh")
+	}
+}
+
+func TestCloseTimeoutAndRepeatedCalls(t *testing.T) {
+	crt, key := newCert(t, "a.example.com")
+	api := kubefake.NewServer()
+	defer api.Close()
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	m := startMonitor(t, api, kubecerthttp.WithOnAdd(func(domain string, cert *tls.Certificate) {
+		close(entered)
+		<-release
+	}))
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("a", "a.example.com", crt, key)})
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The callback wasn't called")
+	}
+
+	// The callback doesn't return, so the monitor can't finish stopping in time
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := m.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Close with a stuck callback returned %v, want context.DeadlineExceeded", err)
+	}
+
+	// Once it returns, closing again waits for the monitor to stop
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := m.Close(context.Background()); err != nil {
+			t.Fatalf("Close %v returned %v", i+2, err)
+		}
+	}
+	if err := m.Refresh("a.example.com"); err == nil {
+		t.Error("Refresh succeeded after Close")
+	}
+
+	// Close after Stop, and on a monitor that was never started
+	stopped := startMonitor(t, api)
+	stopped.Stop()
+	if err := stopped.Close(context.Background()); err != nil {
+		t.Errorf("Close after Stop returned %v", err)
+	}
+	unstarted, err := kubecerthttp.NewUnstartedMonitor(api.URL, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unstarted.Close(context.Background()); err != nil {
+		t.Errorf("Close on an unstarted monitor returned %v", err)
+	}
+	unstarted.Stop()
+}
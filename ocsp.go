@@ -0,0 +1,314 @@
+package kubecerthttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+const (
+	// ocspCheckInterval is how often the staples are checked for needing a refresh
+	ocspCheckInterval = time.Minute
+	// ocspRetryInterval is how long to wait before trying again when fetching a staple failed
+	ocspRetryInterval = 5 * time.Minute
+	// ocspDefaultRefresh is how long a staple is used when the responder doesn't say when the next update is
+	ocspDefaultRefresh = time.Hour
+	// ocspTimeout bounds the time spent talking to an OCSP responder
+	ocspTimeout = 10 * time.Second
+)
+
+// errNoOCSPResponder is returned for certificates that can't be stapled, either because they don't name a responder or their issuer is unknown
+var errNoOCSPResponder = errors.New("Certificate can't be stapled")
+
+var (
+	oidSHA1              = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidOCSPBasicResponse = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+)
+
+// The structures below describe OCSP requests and responses as defined in RFC 6960
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest struct {
+		Version     int `asn1:"explicit,tag:0,default:0,optional"`
+		RequestList []ocspSingleRequest
+	}
+}
+
+type ocspSingleRequest struct {
+	Cert ocspCertID
+}
+
+type ocspResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData struct {
+		Version        int `asn1:"optional,default:0,explicit,tag:0"`
+		RawResponderID asn1.RawValue
+		ProducedAt     time.Time `asn1:"generalized"`
+		Responses      []ocspSingleResponse
+		Extensions     []pkix.Extension `asn1:"explicit,tag:1,optional"`
+	}
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID  ocspCertID
+	Good    asn1.Flag     `asn1:"tag:0,optional"`
+	Revoked asn1.RawValue `asn1:"tag:1,optional"`
+	Unknown asn1.Flag     `asn1:"tag:2,optional"`
+
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+// runOCSPStapler keeps the OCSP staples of the loaded certificates up to date until ctx is cancelled
+func (m *Monitor) runOCSPStapler(ctx context.Context) {
+	client := &http.Client{Timeout: ocspTimeout}
+	ticker := time.NewTicker(ocspCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		m.refreshStaples(ctx, client)
+
+		select {
+		case <-ticker.C:
+		case <-m.stapleTrigger:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshStaples fetches new staples for all the certificates whose staple is missing or due for a refresh
+func (m *Monitor) refreshStaples(ctx context.Context, client *http.Client) {
+	now := time.Now()
+
+	var due []*certEntry
+	m.mutex.RLock()
+	seen := make(map[*certEntry]struct{})
+	for _, candidates := range m.candidates {
+		for _, entry := range candidates {
+			if _, ok := seen[entry]; ok || now.Before(entry.ocspRefresh) {
+				continue
+			}
+			seen[entry] = struct{}{}
+			due = append(due, entry)
+		}
+	}
+	m.mutex.RUnlock()
+
+	for _, entry := range due {
+		m.mutex.RLock()
+		cert := entry.cert
+		m.mutex.RUnlock()
+
+		staple, refresh, expires, err := fetchOCSPStaple(ctx, client, cert)
+		if ctx.Err() != nil {
+			return
+		}
+
+		m.mutex.Lock()
+		// stapleExpires is when the staple kept after a failure stops being served, zero if none is served
+		var stapleExpires time.Time
+		switch {
+		case err == errNoOCSPResponder:
+			// Retrying won't help, the entry gets replaced when the secret changes
+			entry.ocspRefresh = now.Add(100 * 365 * 24 * time.Hour)
+		case err != nil:
+			entry.ocspRefresh = now.Add(ocspRetryInterval)
+			if entry.cert != cert || cert.OCSPStaple == nil || entry.ocspExpires.IsZero() {
+				break
+			}
+			if !now.Before(entry.ocspExpires) {
+				// Clients reject outdated staples, so it's better not to send one at all
+				unstapled := *cert
+				unstapled.OCSPStaple = nil
+				m.replaceEntryCert(entry, &unstapled)
+				entry.ocspExpires = time.Time{}
+				break
+			}
+			// Retry once the staple expires at the latest, so it stops being served if fetching keeps failing
+			stapleExpires = entry.ocspExpires
+			if stapleExpires.Before(entry.ocspRefresh) {
+				entry.ocspRefresh = stapleExpires
+			}
+		case entry.cert == cert:
+			// Served certificates must not be modified, so the staple goes on a copy
+			stapled := *cert
+			stapled.OCSPStaple = staple
+			m.replaceEntryCert(entry, &stapled)
+			entry.ocspRefresh = refresh
+			entry.ocspExpires = expires
+		}
+		m.mutex.Unlock()
+
+		switch {
+		case err == nil || err == errNoOCSPResponder:
+		case !stapleExpires.IsZero():
+			m.log.logf(slog.LevelWarn, "Unable to fetch OCSP staple for secret %v, serving the previous one until %v: %v", entry.secret, stapleExpires.Format(time.RFC3339), err)
+		default:
+			m.log.logf(slog.LevelWarn, "Unable to fetch OCSP staple for secret %v, serving without it: %v", entry.secret, err)
+		}
+	}
+}
+
+// replaceEntryCert replaces the certificate of entry, and serves it for the domains of its secret. The caller must hold m.mutex for writing.
+func (m *Monitor) replaceEntryCert(entry *certEntry, cert *tls.Certificate) {
+	entry.cert = cert
+	for _, domain := range m.secrets[entry.secret] {
+		if candidates := m.candidates[domain]; len(candidates) > 0 {
+			m.setServed(domain, servedCerts(candidates))
+		}
+	}
+	m.publish()
+}
+
+// triggerStapling makes the stapler look for certificates without a staple right away
+func (m *Monitor) triggerStapling() {
+	if m.stapleTrigger == nil {
+		return
+	}
+
+	select {
+	case m.stapleTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// fetchOCSPStaple fetches an OCSP response for the leaf of cert from the responder named in it.
+// It returns the raw response to staple, the time at which it should be refreshed, and the time at which it expires, which is zero if the responder didn't say.
+// The signature of the response isn't verified, that's up to the clients it is stapled for.
+func fetchOCSPStaple(ctx context.Context, client *http.Client, cert *tls.Certificate) (staple []byte, refresh, expires time.Time, err error) {
+	if cert.Leaf == nil || len(cert.Leaf.OCSPServer) == 0 || len(cert.Certificate) < 2 {
+		return nil, time.Time{}, time.Time{}, errNoOCSPResponder
+	}
+
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+
+	id, err := newOCSPCertID(cert.Leaf, issuer)
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+
+	var ocspReq ocspRequest
+	ocspReq.TBSRequest.RequestList = []ocspSingleRequest{{Cert: id}}
+	body, err := asn1.Marshal(ocspReq)
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", cert.Leaf.OCSPServer[0], bytes.NewReader(body))
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, time.Time{}, time.Time{}, errors.New("Invalid status code from OCSP responder: " + resp.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+
+	refresh, expires, err = checkOCSPResponse(raw, id.SerialNumber, time.Now())
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	return raw, refresh, expires, nil
+}
+
+// newOCSPCertID identifies leaf in OCSP requests
+func newOCSPCertID(leaf, issuer *x509.Certificate) (ocspCertID, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return ocspCertID{}, err
+	}
+
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+	return ocspCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash[:],
+		IssuerKeyHash: keyHash[:],
+		SerialNumber:  leaf.SerialNumber,
+	}, nil
+}
+
+// checkOCSPResponse checks that the response says the certificate with the given serial is good, and returns when it should be refreshed and when it expires
+func checkOCSPResponse(raw []byte, serial *big.Int, now time.Time) (refresh, expires time.Time, err error) {
+	var resp ocspResponse
+	if _, err := asn1.Unmarshal(raw, &resp); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if resp.Status != 0 {
+		return time.Time{}, time.Time{}, fmt.Errorf("OCSP responder returned status %d", resp.Status)
+	}
+	if !resp.ResponseBytes.ResponseType.Equal(oidOCSPBasicResponse) {
+		return time.Time{}, time.Time{}, errors.New("Unsupported OCSP response type")
+	}
+
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.ResponseBytes.Response, &basic); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	for _, single := range basic.TBSResponseData.Responses {
+		if single.CertID.SerialNumber == nil || single.CertID.SerialNumber.Cmp(serial) != 0 {
+			continue
+		}
+		if !single.Good {
+			return time.Time{}, time.Time{}, errors.New("OCSP responder doesn't report the certificate as good")
+		}
+
+		// Refresh halfway through the validity of the response, so there's plenty of time to retry
+		if single.NextUpdate.IsZero() {
+			return now.Add(ocspDefaultRefresh), time.Time{}, nil
+		}
+		if !now.Before(single.NextUpdate) {
+			return time.Time{}, time.Time{}, errors.New("OCSP response is already outdated")
+		}
+		return single.ThisUpdate.Add(single.NextUpdate.Sub(single.ThisUpdate) / 2), single.NextUpdate, nil
+	}
+
+	return time.Time{}, time.Time{}, errors.New("OCSP response doesn't cover the certificate")
+}
@@ -0,0 +1,218 @@
+package kubecerthttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ocspChain returns a certificate for a.example.com issued by a test CA, naming responder as its OCSP responder
+func ocspChain(t *testing.T, responder string) *tls.Certificate {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "a.example.com"},
+		DNSNames:     []string{"a.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{responder},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, caTmpl, leafKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{leafDER, caDER}, PrivateKey: leafKey, Leaf: leaf}
+}
+
+// ocspReply returns an OCSP response for the certificate with the given serial, reporting it as good or revoked, valid from thisUpdate to nextUpdate
+func ocspReply(t *testing.T, serial int64, good bool, thisUpdate, nextUpdate time.Time) []byte {
+	t.Helper()
+	single := ocspSingleResponse{
+		CertID:     ocspCertID{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue}, SerialNumber: big.NewInt(serial)},
+		ThisUpdate: thisUpdate.UTC().Truncate(time.Second),
+		NextUpdate: nextUpdate.UTC().Truncate(time.Second),
+	}
+	if good {
+		single.Good = true
+	} else {
+		// RevokedInfo holding the revocation time
+		revokedAt, err := asn1.MarshalWithParams(thisUpdate.UTC().Truncate(time.Second), "generalized")
+		if err != nil {
+			t.Fatal(err)
+		}
+		single.Revoked = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: revokedAt}
+	}
+
+	var basic ocspBasicResponse
+	basic.TBSResponseData.RawResponderID = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: []byte{0x04, 0x00}}
+	basic.TBSResponseData.ProducedAt = thisUpdate.UTC().Truncate(time.Second)
+	basic.TBSResponseData.Responses = []ocspSingleResponse{single}
+	basic.SignatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}}
+	basic.Signature = asn1.BitString{Bytes: []byte{0}, BitLength: 8}
+	basicDER, err := asn1.Marshal(basic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp ocspResponse
+	resp.ResponseBytes.ResponseType = oidOCSPBasicResponse
+	resp.ResponseBytes.Response = basicDER
+	raw, err := asn1.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// ocspResponder returns a responder answering with the response stored in reply
+func ocspResponder(t *testing.T) (*httptest.Server, *atomic.Pointer[[]byte]) {
+	t.Helper()
+	var reply atomic.Pointer[[]byte]
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/ocsp-request" {
+			http.Error(rw, "Bad request", http.StatusBadRequest)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/ocsp-response")
+		rw.Write(*reply.Load())
+	}))
+	t.Cleanup(s.Close)
+	return s, &reply
+}
+
+func TestFetchOCSPStaple(t *testing.T) {
+	responder, reply := ocspResponder(t)
+	cert := ocspChain(t, responder.URL)
+	now := time.Now()
+
+	for _, tt := range []struct {
+		name    string
+		reply   []byte
+		wantErr string
+	}{
+		{"good", ocspReply(t, 42, true, now.Add(-time.Hour), now.Add(3*time.Hour)), ""},
+		{"revoked", ocspReply(t, 42, false, now.Add(-time.Hour), now.Add(3*time.Hour)), "doesn't report the certificate as good"},
+		{"stale next update", ocspReply(t, 42, true, now.Add(-2*time.Hour), now.Add(-time.Hour)), "already outdated"},
+		{"other certificate", ocspReply(t, 43, true, now.Add(-time.Hour), now.Add(3*time.Hour)), "doesn't cover the certificate"},
+		{"malformed", []byte("not an OCSP response"), "asn1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reply.Store(&tt.reply)
+			staple, refresh, expires, err := fetchOCSPStaple(context.Background(), http.DefaultClient, cert)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(staple, tt.reply) {
+				t.Error("The staple isn't the response of the responder")
+			}
+			// Refreshed halfway between this update and next update
+			if want := now.Add(time.Hour).UTC().Truncate(time.Second); !refresh.Equal(want) {
+				t.Errorf("Refresh at %v, want %v", refresh, want)
+			}
+			if want := now.Add(3 * time.Hour).UTC().Truncate(time.Second); !expires.Equal(want) {
+				t.Errorf("Expires at %v, want %v", expires, want)
+			}
+		})
+	}
+
+	responder.Close()
+	if _, _, _, err := fetchOCSPStaple(context.Background(), http.DefaultClient, cert); err == nil {
+		t.Error("Expected an error with the responder down")
+	}
+}
+
+func TestRefreshStaplesKeepsStapleWhileResponderDown(t *testing.T) {
+	responder, reply := ocspResponder(t)
+	cert := ocspChain(t, responder.URL)
+	now := time.Now()
+	good := ocspReply(t, 42, true, now.Add(-time.Hour), now.Add(3*time.Hour))
+	reply.Store(&good)
+
+	m := newMonitor(newConfig(nil))
+	entry := &certEntry{secret: "default/a", cert: cert}
+	m.mutex.Lock()
+	m.candidates["a.example.com"] = []*certEntry{entry}
+	m.secrets["default/a"] = []string{"a.example.com"}
+	m.setServed("a.example.com", servedCerts(m.candidates["a.example.com"]))
+	m.publish()
+	m.mutex.Unlock()
+
+	served := func() []byte {
+		return m.lookup.Load().certMap["a.example.com"][0].OCSPStaple
+	}
+	m.refreshStaples(context.Background(), http.DefaultClient)
+	if !bytes.Equal(served(), good) {
+		t.Fatal("The staple isn't served")
+	}
+
+	// Failing to fetch a new staple keeps the previous one until it expires
+	responder.Close()
+	m.mutex.Lock()
+	entry.ocspRefresh = time.Time{}
+	m.mutex.Unlock()
+	m.refreshStaples(context.Background(), http.DefaultClient)
+	if !bytes.Equal(served(), good) {
+		t.Fatal("The previous staple is no longer served while the responder is down")
+	}
+	m.mutex.RLock()
+	retry := entry.ocspRefresh
+	m.mutex.RUnlock()
+	if !retry.After(now) || retry.After(now.Add(3*time.Hour)) {
+		t.Errorf("Retrying at %v, want before the staple expires", retry)
+	}
+
+	// Once it expired, it isn't served anymore
+	m.mutex.Lock()
+	entry.ocspRefresh = time.Time{}
+	entry.ocspExpires = now.Add(-time.Minute)
+	m.mutex.Unlock()
+	m.refreshStaples(context.Background(), http.DefaultClient)
+	if served() != nil {
+		t.Error("The expired staple is still served")
+	}
+}
@@ -0,0 +1,768 @@
+package kubecerthttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Option configures optional behaviour of NewMonitor and NewTLSConfigWithOptions
+type Option func(*config)
+
+// config holds all the settings that can be changed through options
+type config struct {
+	client     *http.Client
+	hosts      []string
+	aliases    map[string][]string
+	namespaces []string
+
+	hostPattern *regexp.Regexp
+
+	namespaceSources []NamespaceSource
+
+	labelSelector string
+	fieldSelector string
+
+	backoffMin   time.Duration
+	backoffMax   time.Duration
+	restartDelay time.Duration
+	rateLimiter  *rateLimiter
+
+	initialResourceVersion string
+
+	preferredKeyAlgorithm x509.PublicKeyAlgorithm
+
+	onConnectionState ConnectionStateCallback
+
+	domainLabel    string
+	extraNamesKey  string
+	domainFromCert bool
+	domainFromName func(name string) string
+	sanDomains     bool
+
+	defaultCert   *tls.Certificate
+	defaultSecret string
+	staticCerts   map[string]tls.Certificate
+
+	onAdd    CertificateCallback
+	onModify CertificateCallback
+	onDelete CertificateCallback
+
+	logger           *slog.Logger
+	errorLogInterval time.Duration
+
+	validityCheck bool
+	derDetection  bool
+	ocspStapling  bool
+
+	nextProtos   []string
+	minVersion   uint16
+	cipherSuites []uint16
+
+	clientCASecret  string
+	clientCRLSecret string
+
+	keyPassphrase    string
+	keyPassphraseKey string
+
+	filePollInterval time.Duration
+
+	errorOnMissingCert bool
+	stripSNIPort       bool
+
+	debounce time.Duration
+
+	secretsPathTemplate string
+	secretsURL          SecretsURLFunc
+
+	watchTimeout time.Duration
+	maxIdle      time.Duration
+	resyncPeriod time.Duration
+
+	selection    SelectionPolicy
+	certSelector CertSelector
+	perHostCfg   PerHostConfigFunc
+
+	secretTypes   []string
+	certDataKey   string
+	chainDataKeys []string
+	keyDataKey    string
+
+	expiryWarning time.Duration
+	onExpiring    CertificateCallback
+}
+
+// SelectionPolicy decides which certificate is served when multiple secrets claim the same domain
+type SelectionPolicy int
+
+const (
+	// SelectNewestSecret serves the certificate from the most recently created secret, this is the default
+	SelectNewestSecret SelectionPolicy = iota
+	// SelectLatestNotBefore serves the most recently issued certificate
+	SelectLatestNotBefore
+	// SelectLongestValidity serves the certificate that expires last
+	SelectLongestValidity
+	// SelectFirstSeen keeps serving the certificate from the secret that was loaded first, until it is deleted or no longer claims the domain
+	SelectFirstSeen
+)
+
+// CertSelector chooses the certificate for a handshake out of the certificates being served, by domain.
+// The map must not be modified or retained, returning a nil certificate falls back to the default certificate.
+type CertSelector func(hello *tls.ClientHelloInfo, certs map[string]*tls.Certificate) (*tls.Certificate, error)
+
+// WatchState is the state of the connection used to watch the secrets of a namespace
+type WatchState int
+
+const (
+	// WatchConnected means the watch is established and changes to secrets are received
+	WatchConnected WatchState = iota
+	// WatchDisconnected means the watch ended, either cleanly because the API server closed it, or with an error
+	WatchDisconnected
+	// WatchReconnecting means the watch is being established again, possibly after waiting for the reconnect backoff
+	WatchReconnecting
+)
+
+func (s WatchState) String() string {
+	switch s {
+	case WatchConnected:
+		return "Connected"
+	case WatchDisconnected:
+		return "Disconnected"
+	case WatchReconnecting:
+		return "Reconnecting"
+	}
+	return fmt.Sprintf("WatchState(%d)", int(s))
+}
+
+// ConnectionStateCallback is called when the connection used to watch secrets changes state, with the error that caused it if any
+type ConnectionStateCallback func(state WatchState, err error)
+
+// PerHostConfigFunc customizes the TLS config for the server name requested by a client, see WithPerHostConfig
+type PerHostConfigFunc func(host string, base *tls.Config) *tls.Config
+
+// CertificateCallback is called with the domain and certificate affected by a change to the served certificates
+type CertificateCallback func(domain string, cert *tls.Certificate)
+
+// newConfig returns the default config with opts applied to it
+func newConfig(opts []Option) *config {
+	cfg := &config{
+		client:     http.DefaultClient,
+		backoffMin: 5 * time.Second,
+		backoffMax: 5 * time.Minute,
+
+		watchTimeout: 290 * time.Second,
+
+		errorLogInterval: time.Minute,
+
+		domainLabel: "domain",
+
+		secretTypes: []string{"kubernetes.io/tls"},
+		certDataKey: "tls.crt",
+		keyDataKey:  "tls.key",
+
+		validityCheck: true,
+		derDetection:  true,
+
+		nextProtos: []string{"h2", "http/1.1"},
+		minVersion: tls.VersionTLS12,
+	}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return cfg
+}
+
+// isCertSecret returns whether secrets of the given type hold certificates
+func (cfg *config) isCertSecret(secretType string) bool {
+	for _, t := range cfg.secretTypes {
+		if t == secretType {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the config for mistakes that would otherwise only show up once requests are made
+func (cfg *config) validate() error {
+	if err := validateSelector(cfg.labelSelector); err != nil {
+		return fmt.Errorf("Invalid label selector %q: %v", cfg.labelSelector, err)
+	}
+	if err := validateSelector(cfg.fieldSelector); err != nil {
+		return fmt.Errorf("Invalid field selector %q: %v", cfg.fieldSelector, err)
+	}
+	if err := validatePathTemplate(cfg.secretsPathTemplate); err != nil {
+		return fmt.Errorf("Invalid secrets path template %q: %v", cfg.secretsPathTemplate, err)
+	}
+	return nil
+}
+
+// validatePathTemplate checks that a secrets path template has a query, and exactly two %s verbs for the namespace and resource version
+func validatePathTemplate(template string) error {
+	if template == "" {
+		return nil
+	}
+	if !strings.HasPrefix(template, "/") {
+		return fmt.Errorf("must start with /")
+	}
+	if !strings.Contains(template, "?") {
+		return fmt.Errorf("must contain the query, including watch=true")
+	}
+
+	verbs := 0
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			continue
+		}
+		if i+1 == len(template) {
+			return fmt.Errorf("ends with %%")
+		}
+		i++
+		switch template[i] {
+		case 's':
+			verbs++
+		case '%':
+		default:
+			return fmt.Errorf("unexpected verb %%%c, only %%s and %%%% are allowed", template[i])
+		}
+	}
+
+	if verbs != 2 {
+		return fmt.Errorf("must contain exactly two %%s verbs, for the namespace and resource version")
+	}
+	return nil
+}
+
+// validateSelector does a basic sanity check of a kubernetes selector: terms are separated by commas, which can also appear within parentheses for set based requirements
+func validateSelector(selector string) error {
+	if selector == "" {
+		return nil
+	}
+
+	depth := 0
+	term := ""
+	for _, r := range selector + "," {
+		switch {
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("unbalanced parentheses")
+			}
+		case r == ',' && depth == 0:
+			if strings.TrimSpace(term) == "" {
+				return fmt.Errorf("empty requirement")
+			}
+			term = ""
+			continue
+		}
+		term += string(r)
+	}
+
+	if depth != 0 {
+		return fmt.Errorf("unbalanced parentheses")
+	}
+	return nil
+}
+
+// WithHosts sets the hosts to actually fetch certificates for, if left empty all hosts for which certs can be found for will be used
+func WithHosts(hosts ...string) Option {
+	return func(cfg *config) {
+		cfg.hosts = hosts
+	}
+}
+
+// WithHostPattern makes certificates get served for the domains matching pattern, e.g. `.*\.internal\.example\.com` for everything under internal.example.com.
+// The pattern has to match the whole lower case domain. When WithHosts is used as well, a domain is served if it is one of the hosts or matches the pattern,
+// but only the hosts are waited for by Ready. SetHosts leaves the pattern in place.
+func WithHostPattern(pattern *regexp.Regexp) Option {
+	return func(cfg *config) {
+		cfg.hostPattern = nil
+		if pattern != nil {
+			cfg.hostPattern = regexp.MustCompile(`^(?:` + pattern.String() + `)$`)
+		}
+	}
+}
+
+// WithAlias makes the certificate of a domain get served for other names as well, aliases maps each domain to its extra names.
+// This is useful when a service answers to several hostnames, but the certificate only has a single SAN and the secret only names one domain.
+// A certificate loaded for the alias itself takes precedence, aliases only need to be listed in WithHosts if a certificate should be loaded for them as well.
+// Aliases can be changed later on through Monitor.SetAliases.
+func WithAlias(aliases map[string][]string) Option {
+	return func(cfg *config) {
+		cfg.aliases = aliases
+	}
+}
+
+// WithNamespaces sets additional namespaces to watch for secrets, next to the one passed to NewMonitor
+func WithNamespaces(namespaces ...string) Option {
+	return func(cfg *config) {
+		cfg.namespaces = append(cfg.namespaces, namespaces...)
+	}
+}
+
+// NamespaceSource is a namespace to watch with a http client of its own, see WithNamespaceSources
+type NamespaceSource struct {
+	Namespace  string
+	HTTPClient *http.Client // client used for the requests to the kubernetes API, e.g. carrying a token that can only read this namespace. If nil, the client set through WithHTTPClient is used.
+}
+
+// WithNamespaceSources adds namespaces to watch with their own http client, next to the namespace passed to NewMonitor, for clusters where a single token can't read the secrets of all namespaces.
+// The certificates from all namespaces are served together, secrets claiming the same domain are chosen between according to WithSelectionPolicy.
+// Each namespace is watched once, a source for a namespace that is already watched makes it get watched with the client of the source instead, the last one if there are several.
+func WithNamespaceSources(sources ...NamespaceSource) Option {
+	return func(cfg *config) {
+		cfg.namespaceSources = append(cfg.namespaceSources, sources...)
+	}
+}
+
+// WithLabelSelector makes the API server only send secrets matching the given kubernetes label selector, e.g. "app=ingress".
+// This saves bandwidth and CPU when there are many other secrets in the namespace.
+func WithLabelSelector(selector string) Option {
+	return func(cfg *config) {
+		cfg.labelSelector = selector
+	}
+}
+
+// WithFieldSelector makes the API server only send secrets matching the given kubernetes field selector.
+// Use "metadata.name=my-tls-secret" to only watch a single secret, the domain is still taken from its label or certificate.
+func WithFieldSelector(selector string) Option {
+	return func(cfg *config) {
+		cfg.fieldSelector = selector
+	}
+}
+
+// WithHTTPClient sets the http client used for all requests to the kubernetes API.
+// This can be used to set timeouts, proxies or client certificates, by default http.DefaultClient is used.
+// The default client goes through the proxy set in the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables, custom transports should use
+// http.ProxyFromEnvironment as their Proxy to do the same.
+// The client is reused for every reconnect, its idle connections are closed once the monitor stops. Those of http.DefaultClient are left alone, as it is shared.
+func WithHTTPClient(client *http.Client) Option {
+	return func(cfg *config) {
+		if client != nil {
+			cfg.client = client
+		}
+	}
+}
+
+// WithInitialResourceVersion makes watching resume from the given resource version instead of listing the secrets first, e.g. one that was persisted from ResourceVersions before a restart.
+// This avoids listing large namespaces on startup, but only the changes made after the resource version are sent, so secrets that didn't change since aren't seen.
+// It is therefore meant for Watcher users keeping track of the secrets themselves, a monitor would only serve the certificates of secrets that changed.
+// When the API server no longer has the resource version (410 Gone), the secrets are listed as usual. Resource versions are shared by all namespaces of a cluster,
+// so the same one is used for every namespace watched.
+func WithInitialResourceVersion(version string) Option {
+	return func(cfg *config) {
+		cfg.initialResourceVersion = version
+	}
+}
+
+// WithRateLimit limits the requests made to the API server to qps per second on average, allowing bursts of up to burst requests.
+// This covers listing, watching and Refresh for all namespaces of the monitor, and keeps a fleet of replicas from overwhelming the API server after a mass restart.
+// By default requests aren't limited, a qps of 0 or less leaves them unlimited.
+func WithRateLimit(qps float64, burst int) Option {
+	return func(cfg *config) {
+		cfg.rateLimiter = nil
+		if qps > 0 {
+			cfg.rateLimiter = newRateLimiter(qps, burst)
+		}
+	}
+}
+
+// WithReconnectBackoff sets the delays used when reconnecting to kubernetes after the watch failed.
+// The delay starts at min and doubles (with some jitter) after every failed attempt, up to max.
+// Once a watch has been running successfully for a while, the delay is reset to min. The defaults are 5 seconds and 5 minutes.
+func WithReconnectBackoff(min, max time.Duration) Option {
+	return func(cfg *config) {
+		if min <= 0 {
+			return
+		}
+		if max < min {
+			max = min
+		}
+		cfg.backoffMin = min
+		cfg.backoffMax = max
+	}
+}
+
+// WithWatchRestartDelay sets the delay before restarting a watch that the API server ended cleanly, e.g. because its timeout passed, by default it is restarted right away.
+// Watches that fail, or that end cleanly shortly after being established, are restarted using the backoff set through WithReconnectBackoff instead.
+func WithWatchRestartDelay(delay time.Duration) Option {
+	return func(cfg *config) {
+		if delay >= 0 {
+			cfg.restartDelay = delay
+		}
+	}
+}
+
+// WithConnectionStateCallback sets a function to call when the connection to kubernetes changes state, e.g. to show whether the API server is reachable.
+// It is called with WatchConnected once watching starts or resumes, with WatchDisconnected and the error if any when a watch ends,
+// and with WatchReconnecting and the error of the previous attempt before each attempt to watch again. When watching multiple namespaces, it is called for each of them.
+// The callback is called from the goroutine watching the secrets, so it should return quickly.
+func WithConnectionStateCallback(callback ConnectionStateCallback) Option {
+	return func(cfg *config) {
+		cfg.onConnectionState = callback
+	}
+}
+
+// WithDomainLabel sets the label holding the domain a secret contains the certificate for, by default "domain" is used.
+// When a secret doesn't have the label, an annotation with the same key is used instead.
+func WithDomainLabel(key string) Option {
+	return func(cfg *config) {
+		if key != "" {
+			cfg.domainLabel = key
+		}
+	}
+}
+
+// WithExtraNamesLabel sets a label holding a comma separated list of additional names a secret's certificate is served for, next to its domain.
+// When a secret doesn't have the label, an annotation with the same key is used instead, which is needed for multiple names as label values can't contain commas.
+// Whitespace around the names and empty entries are ignored. By default no additional names are read.
+func WithExtraNamesLabel(key string) Option {
+	return func(cfg *config) {
+		cfg.extraNamesKey = key
+	}
+}
+
+// WithDomainFromCertificate makes secrets without a domain label get served for the first DNS name in their certificate, or its common name if it has none.
+// By default such secrets are ignored.
+func WithDomainFromCertificate() Option {
+	return func(cfg *config) {
+		cfg.domainFromCert = true
+	}
+}
+
+// WithDomainFromName makes secrets without a domain label get served for the domain derived from their name by transform, e.g. "api.example.com" for "tls-api-example-com".
+// Secrets for which transform returns an empty string are ignored, unless the domain can be taken from the certificate, see WithDomainFromCertificate.
+func WithDomainFromName(transform func(name string) string) Option {
+	return func(cfg *config) {
+		cfg.domainFromName = transform
+	}
+}
+
+// WithSANDomains makes certificates get served for every DNS name in their subject alternative names, in addition to the domain from the label.
+// This allows a single secret to cover multiple hosts, secrets without a domain label are served for their DNS names only.
+func WithSANDomains() Option {
+	return func(cfg *config) {
+		cfg.sanDomains = true
+	}
+}
+
+// WithDefaultCertificate sets the certificate that is served when no certificate matches the requested server name, or when the client doesn't send one at all.
+func WithDefaultCertificate(cert tls.Certificate) Option {
+	return func(cfg *config) {
+		cfg.defaultCert = &cert
+	}
+}
+
+// WithStaticCertificates makes the given certificates get served for their domains from the start, e.g. ones embedded in the binary.
+// A certificate from a secret claiming the same domain takes precedence, and when the secret is removed again the static certificate is served again.
+// This avoids handshake failures while the certificates are being loaded from kubernetes.
+func WithStaticCertificates(certs map[string]tls.Certificate) Option {
+	return func(cfg *config) {
+		if cfg.staticCerts == nil {
+			cfg.staticCerts = make(map[string]tls.Certificate)
+		}
+		for domain, cert := range certs {
+			cfg.staticCerts[domain] = cert
+		}
+	}
+}
+
+// WithDefaultSecret makes the certificate in the secret with the given name get served when no certificate matches the requested server name.
+// The secret doesn't need a domain label, and takes precedence over WithDefaultCertificate while it exists.
+func WithDefaultSecret(secretName string) Option {
+	return func(cfg *config) {
+		cfg.defaultSecret = secretName
+	}
+}
+
+// WithOnAdd sets a callback that is called whenever a certificate starts being served for a domain that didn't have one.
+// Callbacks are called from the monitor goroutine, while they run no further secret changes are processed, but certificates keep being served.
+func WithOnAdd(callback CertificateCallback) Option {
+	return func(cfg *config) {
+		cfg.onAdd = callback
+	}
+}
+
+// WithOnModify sets a callback that is called whenever the certificate served for a domain is replaced.
+func WithOnModify(callback CertificateCallback) Option {
+	return func(cfg *config) {
+		cfg.onModify = callback
+	}
+}
+
+// WithOnDelete sets a callback that is called whenever a domain no longer has a certificate, cert is the certificate that was removed.
+func WithOnDelete(callback CertificateCallback) Option {
+	return func(cfg *config) {
+		cfg.onDelete = callback
+	}
+}
+
+// WithLogger makes the monitor write its log messages to the given logger, messages about a specific domain carry it in the "domain" attribute.
+// By default, messages are written to the standard log package.
+func WithLogger(logger *slog.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
+
+// WithoutValidityCheck disables checking whether certificates are currently valid before serving them.
+// By default, expired and not yet valid certificates are rejected, and the certificate previously loaded for the domain keeps being served.
+func WithoutValidityCheck() Option {
+	return func(cfg *config) {
+		cfg.validityCheck = false
+	}
+}
+
+// WithoutDERDetection disables converting certificates and keys that aren't PEM encoded, but DER encoded, to PEM.
+// By default, data that doesn't contain a PEM block but parses as DER certificates or a DER private key is accepted as well.
+func WithoutDERDetection() Option {
+	return func(cfg *config) {
+		cfg.derDetection = false
+	}
+}
+
+// WithPerHostConfig sets a function customizing the TLS config per server name, e.g. to require client certificates or restrict the cipher suites for some hosts only.
+// It is called for every handshake with the lower case server name and a copy of the config that would be used otherwise, which it may modify and return.
+// Returning nil uses the config as is. The certificates keep being looked up by the monitor, unless the function replaces GetCertificate.
+func WithPerHostConfig(fn PerHostConfigFunc) Option {
+	return func(cfg *config) {
+		cfg.perHostCfg = fn
+	}
+}
+
+// WithOCSPStapling makes the monitor fetch OCSP responses for the loaded certificates and staple them to the handshakes, refreshing them before they expire.
+// The responder is taken from the certificate, and the issuer must be included in tls.crt. When the responder can't be reached, the certificate is served without a staple.
+func WithOCSPStapling() Option {
+	return func(cfg *config) {
+		cfg.ocspStapling = true
+	}
+}
+
+// WithNextProtos sets the protocols advertised through ALPN, by default "h2" and "http/1.1" are advertised.
+// Use []string{"h2"} for a gRPC only service, or []string{"http/1.1"} to disable http/2.
+func WithNextProtos(protos []string) Option {
+	return func(cfg *config) {
+		cfg.nextProtos = append([]string(nil), protos...)
+	}
+}
+
+// WithClientCA makes the server require client certificates signed by one of the CAs in the ca.crt of the secret with the given name.
+// The secret can be of any type, and is watched like the certificate secrets, so changes to the CAs are picked up without restarting.
+// Until the secret is loaded, or after it is deleted, all handshakes are rejected.
+func WithClientCA(secretName string) Option {
+	return func(cfg *config) {
+		cfg.clientCASecret = secretName
+	}
+}
+
+// WithClientCRLSecret makes the server reject client certificates revoked by the certificate revocation list in the ca.crl of the secret with the given name, use it along with WithClientCA.
+// The list can be PEM or DER encoded. The secret can be of any type, and is watched like the certificate secrets, so an updated list is picked up without restarting.
+// Until the secret is loaded, or after it is deleted, all client certificates are rejected.
+func WithClientCRLSecret(secretName string) Option {
+	return func(cfg *config) {
+		cfg.clientCRLSecret = secretName
+	}
+}
+
+// WithMinVersion sets the minimum TLS version accepted, e.g. tls.VersionTLS13. By default, TLS 1.2 is required.
+func WithMinVersion(version uint16) Option {
+	return func(cfg *config) {
+		cfg.minVersion = version
+	}
+}
+
+// WithCipherSuites restricts the cipher suites used for TLS 1.2 and earlier, by default the crypto/tls defaults are used.
+// When serving http/2, the list must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256.
+func WithCipherSuites(suites []uint16) Option {
+	return func(cfg *config) {
+		cfg.cipherSuites = append([]uint16(nil), suites...)
+	}
+}
+
+// WithKeyPassphrase sets the passphrase used to decrypt private keys stored as PKCS#8 ENCRYPTED PRIVATE KEY in tls.key
+func WithKeyPassphrase(passphrase string) Option {
+	return func(cfg *config) {
+		cfg.keyPassphrase = passphrase
+	}
+}
+
+// WithKeyPassphraseKey makes the passphrase used to decrypt encrypted private keys get read from the given data key of the secret holding the key.
+// Secrets without that key fall back to the passphrase set through WithKeyPassphrase.
+func WithKeyPassphraseKey(dataKey string) Option {
+	return func(cfg *config) {
+		cfg.keyPassphraseKey = dataKey
+	}
+}
+
+// WithFilePollInterval makes monitors created through NewFileMonitor rescan their directory at the given interval, so changed certificates are picked up.
+func WithFilePollInterval(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.filePollInterval = interval
+	}
+}
+
+// WithErrorOnMissingCert makes handshakes for hosts without a certificate fail with a descriptive error, which shows up in the server's error log.
+// By default no certificate is returned, leaving it up to crypto/tls to abort the handshake.
+func WithErrorOnMissingCert(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.errorOnMissingCert = enabled
+	}
+}
+
+// WithDebounce coalesces bursts of changes to the same secret within the given window, so only the latest version of the secret gets parsed and loaded.
+// Deletions are never delayed. By default every change is processed right away.
+func WithDebounce(window time.Duration) Option {
+	return func(cfg *config) {
+		cfg.debounce = window
+	}
+}
+
+// WithSecretsPathTemplate overrides the path used to watch the secrets, for API servers behind a proxy with a non standard layout.
+// The template is appended to the API host, and must contain the query as well as two %s verbs, for the namespace and resource version in that order.
+// The default is "/api/v1/namespaces/%s/secrets?watch=true&allowWatchBookmarks=true&resourceVersion=%s". The namespace is filled in as is, so AllNamespaces needs a template of its own.
+// The secrets are listed using the same path, without the watch, allowWatchBookmarks, resourceVersion and timeoutSeconds parameters.
+func WithSecretsPathTemplate(template string) Option {
+	return func(cfg *config) {
+		cfg.secretsPathTemplate = template
+	}
+}
+
+// SecretsURLFunc returns the URL of the secrets in namespace for the given API host, see WithSecretsURL
+type SecretsURLFunc func(apiHost, namespace string) string
+
+// WithSecretsURL overrides how the URL of the secrets is built, for API servers behind a proxy that changes the layout of the URLs, such as the OpenShift API proxy.
+// The function gets the API host and the namespace, and returns the URL of the secrets collection, e.g. "https://proxy.example.com/k8s/api/v1/namespaces/default/secrets".
+// The parameters for watching, such as the resource version, selectors and timeout, are added to its query, and single secrets are fetched by appending their name to its path.
+// It takes precedence over WithSecretsPathTemplate.
+func WithSecretsURL(fn SecretsURLFunc) Option {
+	return func(cfg *config) {
+		cfg.secretsURL = fn
+	}
+}
+
+// WithWatchTimeout sets how long a single watch request lasts before the API server ends it and it is restarted from the last resource version.
+// By default 290 seconds are used, so watches end cleanly before the 5 minute timeouts common to load balancers cut them off.
+// When the API server doesn't end the watch within 30 seconds after the timeout, the connection is considered dead and closed.
+// Use 0 to keep watches open indefinitely, which relies on TCP keep-alives to detect dead connections.
+func WithWatchTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		if timeout >= 0 {
+			cfg.watchTimeout = timeout
+		}
+	}
+}
+
+// WithWatchIdleTimeout makes the monitor restart watches that don't receive anything for the given duration, for load balancers that keep connections open but stop forwarding data.
+// The API server sends a bookmark about every minute, so a few minutes is a reasonable value. Stalled watches are counted in the kubecerthttp_stalled_watches_total metric.
+// By default, such watches are only restarted once the watch timeout passes, see WithWatchTimeout.
+func WithWatchIdleTimeout(maxIdle time.Duration) Option {
+	return func(cfg *config) {
+		if maxIdle >= 0 {
+			cfg.maxIdle = maxIdle
+		}
+	}
+}
+
+// WithExpiryWarning makes the monitor log a warning once the certificate served for a domain expires within the given threshold, e.g. 30*24*time.Hour.
+// Every certificate is reported once, see WithOnExpiring to be notified as well. By default no warnings are given.
+func WithExpiryWarning(threshold time.Duration) Option {
+	return func(cfg *config) {
+		cfg.expiryWarning = threshold
+	}
+}
+
+// WithOnExpiring sets a callback that is called for each certificate the expiry warning is given for, see WithExpiryWarning
+func WithOnExpiring(callback CertificateCallback) Option {
+	return func(cfg *config) {
+		cfg.onExpiring = callback
+	}
+}
+
+// WithResyncPeriod makes the monitor list all secrets at the given interval, and reconcile the served certificates with them.
+// Certificates are added and updated for secrets that changed, and removed for secrets that no longer exist, which recovers from events missed by the watch.
+// By default no resyncs are done.
+func WithResyncPeriod(period time.Duration) Option {
+	return func(cfg *config) {
+		cfg.resyncPeriod = period
+	}
+}
+
+// WithSecretType sets the types of secrets certificates are loaded from, by default only kubernetes.io/tls secrets are used.
+// Use WithDataKeys when the certificate and key aren't stored in tls.crt and tls.key, as is often the case for Opaque secrets.
+func WithSecretType(types ...string) Option {
+	return func(cfg *config) {
+		if len(types) > 0 {
+			cfg.secretTypes = types
+		}
+	}
+}
+
+// WithDataKeys sets the keys in the secret data holding the PEM encoded certificate and private key, by default "tls.crt" and "tls.key".
+func WithDataKeys(certKey, keyKey string) Option {
+	return func(cfg *config) {
+		if certKey != "" {
+			cfg.certDataKey = certKey
+		}
+		if keyKey != "" {
+			cfg.keyDataKey = keyKey
+		}
+	}
+}
+
+// WithChainDataKeys sets keys in the secret data holding the PEM encoded intermediate certificates, for secrets that store the chain apart from the leaf, e.g. "tls-chain.crt".
+// The intermediates found under these keys are served after the leaf, in the order in which they sign each other. Keys missing from a secret are ignored,
+// but certificates that don't chain to the leaf make the secret fail to load.
+func WithChainDataKeys(keys ...string) Option {
+	return func(cfg *config) {
+		cfg.chainDataKeys = append([]string(nil), keys...)
+	}
+}
+
+// WithSelectionPolicy sets which certificate is served when multiple secrets claim the same domain, by default the one from the most recently created secret.
+// Secrets that are equal according to the policy are ordered by creation time, and then by name.
+func WithSelectionPolicy(policy SelectionPolicy) Option {
+	return func(cfg *config) {
+		cfg.selection = policy
+	}
+}
+
+// WithPreferredKeyAlgorithm makes certificates using the given key algorithm, e.g. x509.RSA or x509.ECDSA, get offered first when a domain has certificates for multiple algorithms.
+// Clients only get another certificate if they don't support the preferred one, which helps with clients that misbehave with one of the algorithms during migrations.
+// A warning is logged for domains that have no certificate using the preferred algorithm. By default the selection policy decides which certificate is offered first.
+func WithPreferredKeyAlgorithm(algorithm x509.PublicKeyAlgorithm) Option {
+	return func(cfg *config) {
+		cfg.preferredKeyAlgorithm = algorithm
+	}
+}
+
+// WithCertSelector replaces the matching of the server name against the domains with a custom selector, which gets the full ClientHelloInfo.
+// The map is a snapshot shared by concurrent handshakes, so the selector must treat it as read-only.
+func WithCertSelector(selector CertSelector) Option {
+	return func(cfg *config) {
+		cfg.certSelector = selector
+	}
+}
+
+// WithSNIPortStripping makes a trailing port get removed from the server name sent by clients before looking up the certificate, e.g. "example.com:443".
+// Standard clients never send a port, but some broken ones do. By default the server name is used as is.
+func WithSNIPortStripping() Option {
+	return func(cfg *config) {
+		cfg.stripSNIPort = true
+	}
+}
+
+// WithErrorLogInterval sets how often an error that keeps occurring while watching the secrets is logged, by default once a minute.
+// Repeats in between are counted, and the count is logged once a different error occurs or the interval has passed. Use 0 to log every error.
+func WithErrorLogInterval(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.errorLogInterval = interval
+	}
+}
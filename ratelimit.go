@@ -0,0 +1,68 @@
+package kubecerthttp
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting the requests made to the API server, see WithRateLimit.
+// A nil rateLimiter doesn't limit anything.
+type rateLimiter struct {
+	qps   float64
+	burst float64
+	now   func() time.Time // returns the current time, replaced in tests
+
+	mutex  sync.Mutex
+	tokens float64   // tokens left, negative when requests are waiting for tokens
+	last   time.Time // time at which tokens was last updated
+}
+
+// newRateLimiter returns a rate limiter allowing qps requests per second, in bursts of up to burst requests
+func newRateLimiter(qps float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{qps: qps, burst: float64(burst), now: time.Now, tokens: float64(burst), last: time.Now()}
+}
+
+// wait blocks until a request may be made, or until ctx is done, in which case its error is returned
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	delay := l.reserve()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Give the token back, as no request is made
+		l.mutex.Lock()
+		l.tokens++
+		l.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+// reserve takes a token right away, and returns how long to wait for it to be refilled if there were none left
+func (l *rateLimiter) reserve() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.qps)
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.qps * float64(time.Second))
+}
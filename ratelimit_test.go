@@ -0,0 +1,74 @@
+package kubecerthttp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		qps   float64
+		burst int
+		steps []struct{ advance, delay time.Duration } // time passed before each request, and how long it has to wait
+	}{
+		{"burst then refill", 2, 3, []struct{ advance, delay time.Duration }{
+			{0, 0}, {0, 0}, {0, 0},
+			{0, 500 * time.Millisecond},
+			{0, time.Second},
+			{time.Second, 500 * time.Millisecond},
+			// Tokens don't pile up beyond the burst
+			{10 * time.Second, 0}, {0, 0}, {0, 0}, {0, 500 * time.Millisecond},
+		}},
+		{"minimum burst of one", 1, 0, []struct{ advance, delay time.Duration }{
+			{0, 0},
+			{0, time.Second},
+			{500 * time.Millisecond, 1500 * time.Millisecond},
+		}},
+		{"partial refill", 4, 1, []struct{ advance, delay time.Duration }{
+			{0, 0},
+			{100 * time.Millisecond, 150 * time.Millisecond},
+			{time.Second, 0},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			l := newRateLimiter(tt.qps, tt.burst)
+			l.now = func() time.Time { return now }
+			l.last = now
+
+			for i, step := range tt.steps {
+				now = now.Add(step.advance)
+				if delay := l.reserve(); delay != step.delay {
+					t.Errorf("Request %v waits %v, want %v", i, delay, step.delay)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(1, 1)
+	l.now = func() time.Time { return now }
+	l.last = now
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cancelled wait gives its token back, so the next request doesn't wait for it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx); err != context.Canceled {
+		t.Fatalf("Waiting with a cancelled context returned %v", err)
+	}
+	if delay := l.reserve(); delay != time.Second {
+		t.Errorf("Request after a cancelled one waits %v, want 1s", delay)
+	}
+
+	var nilLimiter *rateLimiter
+	if err := nilLimiter.wait(ctx); err != nil {
+		t.Errorf("A nil rate limiter returned %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package kubecerthttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Refresh fetches the secret holding the certificate for domain again and loads it right away, instead of waiting for the watch to report a change.
+// This is useful after rotating a secret out of band, or in scripts and tests. An error is returned if no secret is known for the domain,
+// the secret no longer exists or its certificate can't be loaded, in which case the certificate being served is kept.
+func (m *Monitor) Refresh(domain string) error {
+	return m.RefreshContext(context.Background(), domain)
+}
+
+// RefreshContext is like Refresh, but fetching the secret is aborted once ctx is done, so it can be called from request handlers with a deadline.
+func (m *Monitor) RefreshContext(ctx context.Context, domain string) error {
+	if m.watcher == nil {
+		return errors.New("Refresh is only supported for monitors watching kubernetes")
+	}
+	m.handling.Lock()
+	closed := m.closed
+	m.handling.Unlock()
+	if closed {
+		return errors.New("Monitor is closed")
+	}
+	domain = strings.ToLower(domain)
+
+	secretKey, ok := m.secretFor(domain)
+	if !ok {
+		return fmt.Errorf("No secret found for domain %v", domain)
+	}
+	namespace, name, _ := strings.Cut(secretKey, "/")
+
+	s, err := m.watcher.getSecret(ctx, namespace, name)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound {
+		return fmt.Errorf("Secret %v for domain %v no longer exists", secretKey, domain)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to fetch secret %v for domain %v: %w", secretKey, domain, err)
+	}
+
+	// Load the certificate up front to report why it can't be served, handling the event keeps the previous one in that case
+	if _, err := m.loadCert(domain, secretKey, s); err != nil {
+		return fmt.Errorf("Unable to load secret %v for domain %v: %w", secretKey, domain, err)
+	}
+
+	m.handleEvent(secretEvent{Type: "MODIFIED", Object: *s})
+	return nil
+}
+
+// secretFor returns the namespace/name of the secret claiming domain, preferring the one being served
+func (m *Monitor) secretFor(domain string) (string, bool) {
+	m.mutex.RLock()
+	candidates := m.candidates[domain]
+	var served string
+	if len(candidates) > 0 && !candidates[0].static {
+		served = candidates[0].secret
+	}
+	m.mutex.RUnlock()
+	if served != "" {
+		return served, true
+	}
+
+	// Secrets that failed to load aren't candidates, but their last event is kept
+	m.handling.Lock()
+	defer m.handling.Unlock()
+
+	keys := make([]string, 0, len(m.latest))
+	for key := range m.latest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		event := m.latest[key]
+		for _, d := range m.secretDomains(&event.Object) {
+			if d == domain {
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
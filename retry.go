@@ -0,0 +1,50 @@
+package kubecerthttp
+
+import (
+	"context"
+	"time"
+)
+
+// retryInterval is how often loading the certificates of secrets that failed is attempted again.
+// This covers secrets that were only partially written, and certificates that weren't valid yet.
+const retryInterval = time.Minute
+
+// runRetrier periodically retries the secrets whose certificate couldn't be loaded until ctx is cancelled
+func (m *Monitor) runRetrier(ctx context.Context) {
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.retryFailed()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// retryFailed handles the last event of every failed secret again
+func (m *Monitor) retryFailed() {
+	m.handling.Lock()
+	defer m.handling.Unlock()
+
+	events := make([]secretEvent, 0, len(m.failed))
+	for _, event := range m.failed {
+		events = append(events, event)
+	}
+	for _, event := range events {
+		m.applyEvent(event)
+	}
+}
+
+// setFailed records the event as the last one of a secret that failed to load, or forgets about the secret if event is nil.
+// The caller must hold m.handling.
+func (m *Monitor) setFailed(secretKey string, event *secretEvent) {
+	if event != nil {
+		m.failed[secretKey] = *event
+	} else {
+		delete(m.failed, secretKey)
+	}
+	m.metrics.failedSecrets.Store(int64(len(m.failed)))
+}
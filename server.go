@@ -0,0 +1,265 @@
+package kubecerthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultReadHeaderTimeout is the time clients get to send the request headers to the servers started by this package, which protects against Slowloris attacks
+	DefaultReadHeaderTimeout = 10 * time.Second
+	// DefaultIdleTimeout is how long the servers started by this package keep idle keep-alive connections open
+	DefaultIdleTimeout = 2 * time.Minute
+	// DefaultShutdownTimeout is how long ListenAndServeTLSContext waits for connections to drain, it fits within the default kubernetes termination grace period
+	DefaultShutdownTimeout = 25 * time.Second
+)
+
+// newServer returns a server using the default timeouts
+func newServer(addr string, handler http.Handler, tlsCfg *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         tlsCfg,
+		ReadHeaderTimeout: DefaultReadHeaderTimeout,
+		IdleTimeout:       DefaultIdleTimeout,
+	}
+}
+
+// ListenAndServeTLSServer is like ListenAndServeTLS, but starts the given server, so its timeouts and other settings can be configured.
+// The certificates from kubernetes are injected into a copy of srv.TLSConfig, if srv.TLSConfig is nil the config returned by NewTLSConfig is used as is.
+// Settings srv leaves zero get the defaults of ListenAndServeTLS: the protocols and minimum TLS version of NewTLSConfig, and unless ReadTimeout is set, DefaultReadHeaderTimeout and DefaultIdleTimeout.
+func ListenAndServeTLSServer(srv *http.Server, apiHost, namespace string, hosts ...string) error {
+	tlsCfg, err := NewTLSConfig(apiHost, namespace, hosts...)
+	if err != nil {
+		return err
+	}
+
+	if srv.TLSConfig != nil {
+		custom := srv.TLSConfig.Clone()
+		custom.GetCertificate = tlsCfg.GetCertificate
+		if len(custom.NextProtos) == 0 {
+			custom.NextProtos = tlsCfg.NextProtos
+		}
+		if custom.MinVersion == 0 {
+			custom.MinVersion = tlsCfg.MinVersion
+		}
+		tlsCfg = custom
+	}
+
+	// Zero timeouts fall back to ReadTimeout in net/http, so they are only defaulted when it isn't set either
+	if srv.ReadTimeout == 0 {
+		if srv.ReadHeaderTimeout == 0 {
+			srv.ReadHeaderTimeout = DefaultReadHeaderTimeout
+		}
+		if srv.IdleTimeout == 0 {
+			srv.IdleTimeout = DefaultIdleTimeout
+		}
+	}
+
+	srv.TLSConfig = tlsCfg
+	return srv.ListenAndServeTLS("", "")
+}
+
+// NewTLSConfigForServer is like NewTLSConfigWithOptions, but also sets up srv to serve http/2 with the returned config, which it sets as srv.TLSConfig.
+// net/http only serves http/2 when "h2" is advertised through ALPN, srv.TLSNextProto is nil, and for TLS 1.2 the cipher suites include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+// or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, which http/2 requires. Otherwise http/2 silently ends up disabled, or starting the server fails, so an error is returned for these
+// instead, e.g. when WithCipherSuites leaves out the required suites. Start srv with ListenAndServeTLS("", "") or ServeTLS, which configure http/2 like http2.ConfigureServer does.
+func NewTLSConfigForServer(srv *http.Server, apiHost, namespace string, opts ...Option) (*tls.Config, error) {
+	m, err := NewMonitor(context.Background(), apiHost, namespace, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg := m.TLSConfig()
+	if err := checkHTTP2(srv, tlsCfg); err != nil {
+		m.Stop()
+		return nil, err
+	}
+
+	srv.TLSConfig = tlsCfg
+	return tlsCfg, nil
+}
+
+// checkHTTP2 returns an error if serving tlsCfg through srv wouldn't support http/2
+func checkHTTP2(srv *http.Server, tlsCfg *tls.Config) error {
+	if srv.TLSNextProto != nil {
+		if _, ok := srv.TLSNextProto["h2"]; !ok {
+			return errors.New("HTTP/2 is disabled by the TLSNextProto of the server")
+		}
+	}
+
+	h2 := false
+	for _, proto := range tlsCfg.NextProtos {
+		h2 = h2 || proto == "h2"
+	}
+	if !h2 {
+		return fmt.Errorf("HTTP/2 is disabled by the protocols %v, \"h2\" must be included", tlsCfg.NextProtos)
+	}
+
+	// TLS 1.3 cipher suites can't be configured, and all of them are fine for http/2
+	if tlsCfg.CipherSuites == nil || tlsCfg.MinVersion >= tls.VersionTLS13 {
+		return nil
+	}
+	for _, suite := range tlsCfg.CipherSuites {
+		if suite == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || suite == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return nil
+		}
+	}
+	return errors.New("HTTP/2 requires the cipher suites to include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+}
+
+// ServeTLS is like ListenAndServeTLS, but serves on an existing listener instead of binding addr itself, e.g. one from systemd socket activation or a test.
+// The connections accepted from l are wrapped with TLS using the config returned by NewTLSConfig. ServeTLS always returns a non-nil error, and closes l when it does.
+func ServeTLS(l net.Listener, apiHost, namespace string, handler http.Handler, hosts ...string) error {
+	tlsCfg, err := NewTLSConfig(apiHost, namespace, hosts...)
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	srv := newServer(l.Addr().String(), handler, tlsCfg)
+	return srv.Serve(tls.NewListener(l, tlsCfg))
+}
+
+// ListenAndServeTLSContext is like ListenAndServeTLS, but gracefully shuts down the server once ctx is cancelled, which also stops the certificate monitor.
+// Shutting down stops accepting new connections and waits up to DefaultShutdownTimeout for active ones to finish.
+// It returns nil after a graceful shutdown, the error from http.Server.Shutdown if connections didn't finish in time, or the error that made the server fail.
+// Unlike http.Server.ListenAndServeTLS, http.ErrServerClosed is never returned.
+func ListenAndServeTLSContext(ctx context.Context, addr string, apiHost, namespace string, handler http.Handler, hosts ...string) error {
+	m, err := NewMonitor(ctx, apiHost, namespace, WithHosts(hosts...))
+	if err != nil {
+		return err
+	}
+	defer m.Stop()
+
+	srv := newServer(addr, handler, m.TLSConfig())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServeTLS("", "")
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	// ctx is already done, so draining gets a deadline of its own
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+
+	if err := <-errc; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// ListenAndServeTLSWithRedirect starts a http and http/2 server like ListenAndServeTLS on httpsAddr, and a plain http server on httpAddr that redirects all requests to https.
+// The redirects are permanent (301), and keep the host, path and query of the request. Redirects go to port 443 when httpsAddr is empty or has no port.
+// It returns as soon as either server fails, after shutting down the other one, waiting up to DefaultShutdownTimeout for its connections, and stopping the certificate monitor.
+func ListenAndServeTLSWithRedirect(httpsAddr, httpAddr string, apiHost, namespace string, handler http.Handler, hosts ...string) error {
+	httpsPort := "443"
+	if httpsAddr != "" {
+		_, port, err := net.SplitHostPort(httpsAddr)
+		if err != nil {
+			return err
+		}
+		if port != "" {
+			httpsPort = port
+		}
+	}
+
+	m, err := NewMonitor(context.Background(), apiHost, namespace, WithHosts(hosts...))
+	if err != nil {
+		return err
+	}
+	defer m.Stop()
+
+	httpsSrv := newServer(httpsAddr, handler, m.TLSConfig())
+	httpSrv := newServer(httpAddr, redirectHandler(httpsPort), nil)
+	errc := make(chan error, 2)
+	go func() {
+		errc <- httpsSrv.ListenAndServeTLS("", "")
+	}()
+	go func() {
+		errc <- httpSrv.ListenAndServe()
+	}()
+	err = <-errc
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	httpsSrv.Shutdown(shutdownCtx)
+	httpSrv.Shutdown(shutdownCtx)
+	<-errc
+	return err
+}
+
+// redirectHandler redirects all requests to the same URL over https, on the given port
+func redirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" && httpsPort != "https" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
+
+// Server is a http and http/2 server serving the certificates found by a Monitor, returned by NewServerTLS
+type Server struct {
+	srv     *http.Server
+	monitor *Monitor
+}
+
+// NewServerTLS is like ListenAndServeTLS, but returns the server instead of starting it, so it can be inspected and shut down.
+// The certificate monitor is started right away, call ListenAndServeTLS on the returned server to start serving.
+// The server uses DefaultReadHeaderTimeout and DefaultIdleTimeout, they can be changed through HTTPServer before it is started.
+func NewServerTLS(addr string, apiHost, namespace string, handler http.Handler, hosts ...string) (*Server, error) {
+	m, err := NewMonitor(context.Background(), apiHost, namespace, WithHosts(hosts...))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{srv: newServer(addr, handler, m.TLSConfig()), monitor: m}, nil
+}
+
+// ListenAndServeTLS listens on the address of the server and serves https, it always returns a non-nil error.
+// After Shutdown, http.ErrServerClosed is returned.
+func (s *Server) ListenAndServeTLS() error {
+	return s.srv.ListenAndServeTLS("", "")
+}
+
+// Shutdown gracefully shuts down the server like http.Server.Shutdown, and then stops the certificate monitor
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	s.monitor.Stop()
+	return err
+}
+
+// Domains returns the domains a certificate is currently loaded for, sorted alphabetically
+func (s *Server) Domains() []string {
+	return s.monitor.Domains()
+}
+
+// HTTPServer returns the underlying http server
+func (s *Server) HTTPServer() *http.Server {
+	return s.srv
+}
+
+// Monitor returns the monitor providing the certificates, e.g. to expose its MetricsHandler
+func (s *Server) Monitor() *Monitor {
+	return s.monitor
+}
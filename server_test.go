@@ -0,0 +1,86 @@
+package kubecerthttp_test
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	kubecerthttp "github.com/PalmStoneGames/kube-cert-http"
+	"github.com/PalmStoneGames/kube-cert-http/kubefake"
+)
+
+func TestListenAndServeTLSWithRedirectShutsDownOnFailure(t *testing.T) {
+	api := kubefake.NewServer()
+	defer api.Close()
+
+	// The https address is taken, so serving fails right away
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpAddr := free.Addr().String()
+	free.Close()
+
+	err = kubecerthttp.ListenAndServeTLSWithRedirect(taken.Addr().String(), httpAddr, api.URL, "default", http.NotFoundHandler())
+	if err == nil {
+		t.Fatal("Expected an error for the address in use")
+	}
+
+	// The redirect server must have been shut down along with it
+	l, err := net.Listen("tcp", httpAddr)
+	if err != nil {
+		t.Fatalf("The http address is still in use: %v", err)
+	}
+	l.Close()
+}
+
+func TestListenAndServeTLSServerDefaults(t *testing.T) {
+	api := kubefake.NewServer()
+	defer api.Close()
+
+	// The address is taken, so serving fails right away, after the server was set up
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	for _, tt := range []struct {
+		name              string
+		srv               *http.Server
+		readHeaderTimeout time.Duration
+		idleTimeout       time.Duration
+	}{
+		{"zero", &http.Server{}, kubecerthttp.DefaultReadHeaderTimeout, kubecerthttp.DefaultIdleTimeout},
+		{"custom TLS config", &http.Server{TLSConfig: &tls.Config{}}, kubecerthttp.DefaultReadHeaderTimeout, kubecerthttp.DefaultIdleTimeout},
+		{"custom timeouts", &http.Server{ReadHeaderTimeout: time.Second, IdleTimeout: time.Minute}, time.Second, time.Minute},
+		{"read timeout", &http.Server{ReadTimeout: time.Second}, 0, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.srv.Addr = taken.Addr().String()
+			if err := kubecerthttp.ListenAndServeTLSServer(tt.srv, api.URL, "default"); err == nil {
+				t.Fatal("Expected an error for the address in use")
+			}
+			if tt.srv.ReadHeaderTimeout != tt.readHeaderTimeout || tt.srv.IdleTimeout != tt.idleTimeout {
+				t.Errorf("Timeouts are %v and %v, want %v and %v", tt.srv.ReadHeaderTimeout, tt.srv.IdleTimeout, tt.readHeaderTimeout, tt.idleTimeout)
+			}
+			if v := tt.srv.TLSConfig.MinVersion; v != tls.VersionTLS12 {
+				t.Errorf("Minimum TLS version is %x, want TLS 1.2", v)
+			}
+		})
+	}
+
+	// A minimum version set on the template is kept
+	srv := &http.Server{Addr: taken.Addr().String(), TLSConfig: &tls.Config{MinVersion: tls.VersionTLS13}}
+	kubecerthttp.ListenAndServeTLSServer(srv, api.URL, "default")
+	if v := srv.TLSConfig.MinVersion; v != tls.VersionTLS13 {
+		t.Errorf("Minimum TLS version is %x, want TLS 1.3", v)
+	}
+}
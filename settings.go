@@ -0,0 +1,81 @@
+package kubecerthttp
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// errNoClientCAs is returned during handshakes while the client CA secret isn't loaded
+var errNoClientCAs = errors.New("Client CA certificates haven't been loaded")
+
+// TLSSettings are the settings of the TLS config that can be changed while serving, see SetTLSSettings.
+// Fields left at their zero value keep the value set through the options.
+type TLSSettings struct {
+	MinVersion   uint16
+	CipherSuites []uint16
+	NextProtos   []string
+}
+
+// SetTLSSettings changes the settings of the TLS config returned by TLSConfig, e.g. to raise the minimum version in response to a security advisory.
+// The settings apply to new handshakes right away, connections that are already established aren't affected.
+func (m *Monitor) SetTLSSettings(settings TLSSettings) {
+	m.mutex.Lock()
+	m.tlsSettings = &settings
+	m.updateClientConfig()
+	m.publish()
+	m.mutex.Unlock()
+}
+
+// getConfigForClient is used as GetConfigForClient, it returns the config with the settings that changed since tlsCfg was created, customized for the host through WithPerHostConfig
+func (m *Monitor) getConfigForClient(clientHello *tls.ClientHelloInfo) (*tls.Config, error) {
+	l := m.lookup.Load()
+	cfg, clientCAs := l.clientCfg, l.clientCAs
+
+	// Without a pool, client certificates would be verified against the system roots, so refuse the handshake instead
+	if m.cfg.clientCASecret != "" && clientCAs == nil {
+		return nil, errNoClientCAs
+	}
+
+	if m.cfg.perHostCfg != nil {
+		base := cfg
+		if base == nil {
+			base = m.tlsCfg
+		}
+		base = base.Clone()
+		base.GetConfigForClient = nil
+		if hostCfg := m.cfg.perHostCfg(m.serverName(clientHello), base); hostCfg != nil {
+			return hostCfg, nil
+		}
+		return base, nil
+	}
+
+	// A nil config makes the handshake use tlsCfg
+	return cfg, nil
+}
+
+// updateClientConfig rebuilds the config returned by getConfigForClient, the caller must hold m.mutex for writing
+func (m *Monitor) updateClientConfig() {
+	if m.clientCAs == nil && m.tlsSettings == nil {
+		m.clientCfg = nil
+		return
+	}
+
+	cfg := m.tlsCfg.Clone()
+	cfg.GetConfigForClient = nil
+	if m.clientCAs != nil {
+		cfg.ClientCAs = m.clientCAs
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if s := m.tlsSettings; s != nil {
+		if s.MinVersion != 0 {
+			cfg.MinVersion = s.MinVersion
+		}
+		if s.CipherSuites != nil {
+			cfg.CipherSuites = s.CipherSuites
+		}
+		if s.NextProtos != nil {
+			cfg.NextProtos = s.NextProtos
+		}
+	}
+	m.clientCfg = cfg
+}
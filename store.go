@@ -0,0 +1,113 @@
+package kubecerthttp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// CertStore is a source of certificates by domain, such as a Monitor, so the same TLS setup can be backed by kubernetes, files or another service.
+// Use NewTLSConfigFromStore to serve the certificates of a store.
+type CertStore interface {
+	// Get returns the certificate for the given lower case name, and whether there is one
+	Get(name string) (*tls.Certificate, bool)
+	// Subscribe makes the store send the changes to its certificates on events until unsubscribe is called
+	Subscribe(events chan<- CertEvent) (unsubscribe func())
+}
+
+// CertEvent is a change to the certificate of a domain in a CertStore
+type CertEvent struct {
+	Type   string // ADDED, MODIFIED or DELETED
+	Domain string
+	Cert   *tls.Certificate // certificate being served from now on, or the one that was removed for DELETED
+}
+
+// NewTLSConfigFromStore returns a TLS config serving the certificates of store.
+// When store has no certificate for the requested server name, the wildcard certificate for its parent domain is used if there is one.
+// Like with a Monitor, no certificate is returned for other names unless WithErrorOnMissingCert is set, and TLS 1.2 is required by default.
+// Of the options, only WithErrorOnMissingCert, WithMinVersion, WithCipherSuites and WithNextProtos apply.
+// By default, the tls.Config is configured to work with http/1.1 and http/2.
+func NewTLSConfigFromStore(store CertStore, opts ...Option) *tls.Config {
+	cfg := newConfig(opts)
+	return &tls.Config{
+		GetCertificate: func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := strings.ToLower(clientHello.ServerName)
+			if cert, ok := store.Get(name); ok {
+				return cert, nil
+			}
+			if i := strings.IndexByte(name, '.'); i > 0 {
+				if cert, ok := store.Get("*" + name[i:]); ok {
+					return cert, nil
+				}
+			}
+			if cfg.errorOnMissingCert {
+				return nil, fmt.Errorf("No certificate for host %q", clientHello.ServerName)
+			}
+			return nil, nil
+		},
+		NextProtos:   cfg.nextProtos,
+		MinVersion:   cfg.minVersion,
+		CipherSuites: cfg.cipherSuites,
+	}
+}
+
+// Get returns the certificate served for name, resolving aliases, but not falling back to wildcard or default certificates.
+// When there are certificates for multiple key algorithms, the preferred one is returned. Get makes Monitor a CertStore.
+func (m *Monitor) Get(name string) (*tls.Certificate, bool) {
+	l := m.lookup.Load()
+	cert, ok := l.preferred[name]
+	if domain, isAlias := l.aliasMap[name]; !ok && isAlias {
+		cert, ok = l.preferred[domain]
+	}
+	return cert, ok
+}
+
+// subscription is a channel passed to Subscribe, cancelled is closed once it is unsubscribed
+type subscription struct {
+	events    chan<- CertEvent
+	cancelled chan struct{}
+}
+
+// Subscribe makes the monitor send the changes to the certificates it serves on events, next to the callbacks set through options, until unsubscribe is called.
+// Events should be received continuously, as handling changes to secrets is paused while an event isn't received. Stopping the monitor or unsubscribing
+// drops the event being sent, so a subscriber that stopped receiving can't keep the monitor from stopping.
+func (m *Monitor) Subscribe(events chan<- CertEvent) (unsubscribe func()) {
+	sub := &subscription{events: events, cancelled: make(chan struct{})}
+
+	m.mutex.Lock()
+	m.subscribers = append(m.subscribers, sub)
+	m.mutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mutex.Lock()
+			// notify may be ranging over the previous slice, so it is replaced instead of modified
+			subscribers := make([]*subscription, 0, len(m.subscribers))
+			for _, s := range m.subscribers {
+				if s != sub {
+					subscribers = append(subscribers, s)
+				}
+			}
+			m.subscribers = subscribers
+			m.mutex.Unlock()
+			close(sub.cancelled)
+		})
+	}
+}
+
+// notify sends event to the subscribers of the monitor
+func (m *Monitor) notify(event CertEvent) {
+	m.mutex.RLock()
+	subscribers := m.subscribers
+	m.mutex.RUnlock()
+
+	for _, sub := range subscribers {
+		select {
+		case sub.events <- event:
+		case <-sub.cancelled:
+		case <-m.stopping:
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package kubecerthttp_test
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	kubecerthttp "github.com/PalmStoneGames/kube-cert-http"
+	"github.com/PalmStoneGames/kube-cert-http/kubefake"
+)
+
+func TestStuckSubscriberDoesNotBlockStop(t *testing.T) {
+	crt, key := newCert(t, "a.example.com", "b.example.com")
+	api := kubefake.NewServer()
+	defer api.Close()
+
+	m, err := kubecerthttp.NewMonitor(context.Background(), api.URL, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nobody receives from the channel, so the first change blocks handling
+	m.Subscribe(make(chan kubecerthttp.CertEvent))
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("a", "a.example.com", crt, key)})
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("b", "b.example.com", crt, key)})
+	waitFor(t, "a.example.com to be served", func() bool {
+		_, ok := m.Get("a.example.com")
+		return ok
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	crt, key := newCert(t, "a.example.com", "b.example.com")
+	api := kubefake.NewServer()
+	defer api.Close()
+
+	m, err := kubecerthttp.NewMonitor(context.Background(), api.URL, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	stuck := m.Subscribe(make(chan kubecerthttp.CertEvent))
+	events := make(chan kubecerthttp.CertEvent, 2)
+	unsubscribe := m.Subscribe(events)
+
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("a", "a.example.com", crt, key)})
+	waitFor(t, "a.example.com to be served", func() bool {
+		_, ok := m.Get("a.example.com")
+		return ok
+	})
+	// Unsubscribing the stuck channel lets the event through to the other one
+	stuck()
+	select {
+	case event := <-events:
+		if event.Type != "ADDED" || event.Domain != "a.example.com" {
+			t.Fatalf("Unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the event")
+	}
+
+	unsubscribe()
+	unsubscribe()
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("b", "b.example.com", crt, key)})
+	waitFor(t, "b.example.com to be served", func() bool {
+		_, ok := m.Get("b.example.com")
+		return ok
+	})
+	select {
+	case event := <-events:
+		t.Fatalf("Unexpected event after unsubscribing %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// mapStore is a CertStore serving a fixed set of certificates
+type mapStore map[string]*tls.Certificate
+
+func (s mapStore) Get(name string) (*tls.Certificate, bool) {
+	cert, ok := s[name]
+	return cert, ok
+}
+
+func (s mapStore) Subscribe(events chan<- kubecerthttp.CertEvent) func() {
+	return func() {}
+}
+
+func TestTLSConfigFromStore(t *testing.T) {
+	crt, key := newCert(t, "*.example.com")
+	cert, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mapStore{"*.example.com": &cert}
+
+	cfg := kubecerthttp.NewTLSConfigFromStore(store)
+	if cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("MinVersion is %x, want TLS 1.2", cfg.MinVersion)
+	}
+	if got, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "A.example.com"}); err != nil || got != &cert {
+		t.Errorf("Wildcard lookup returned %v, %v", got, err)
+	}
+	if got, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.org"}); err != nil || got != nil {
+		t.Errorf("Missing host returned %v, %v, want nil, nil", got, err)
+	}
+
+	cfg = kubecerthttp.NewTLSConfigFromStore(store, kubecerthttp.WithErrorOnMissingCert(true), kubecerthttp.WithMinVersion(tls.VersionTLS13))
+	if cfg.MinVersion != tls.VersionTLS13 {
+		t.Errorf("MinVersion is %x, want TLS 1.3", cfg.MinVersion)
+	}
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.org"}); err == nil {
+		t.Error("Missing host didn't return an error with WithErrorOnMissingCert")
+	}
+}
@@ -0,0 +1,95 @@
+package kubecerthttp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	kubecerthttp "github.com/PalmStoneGames/kube-cert-http"
+	"github.com/PalmStoneGames/kube-cert-http/kubefake"
+)
+
+// newCert returns a PEM encoded self-signed certificate for names and its private key
+func newCert(t testing.TB, names ...string) (crt, key []byte) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return selfSigned(t, priv, names...), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// selfSigned returns a PEM encoded certificate for names, signed by priv itself
+func selfSigned(t testing.TB, priv crypto.Signer, names ...string) []byte {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// tlsSecret returns a kubernetes.io/tls secret in the default namespace holding the certificate for domain
+func tlsSecret(name, domain string, crt, key []byte) kubefake.Secret {
+	return kubefake.Secret{
+		Namespace: "default",
+		Name:      name,
+		Labels:    map[string]string{"domain": domain},
+		Data:      map[string][]byte{"tls.crt": crt, "tls.key": key},
+	}
+}
+
+// waitFor fails the test if cond doesn't become true within a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startMonitor starts a monitor watching the default namespace of api, which reconnects quickly and is stopped when the test ends
+func startMonitor(t *testing.T, api *kubefake.Server, opts ...kubecerthttp.Option) *kubecerthttp.Monitor {
+	t.Helper()
+	opts = append([]kubecerthttp.Option{kubecerthttp.WithReconnectBackoff(10*time.Millisecond, 10*time.Millisecond)}, opts...)
+	m, err := kubecerthttp.NewMonitor(context.Background(), api.URL, "default", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Stop)
+	return m
+}
+
+// serves returns whether the monitor serves the PEM encoded certificate crt to clients asking for serverName
+func serves(m *kubecerthttp.Monitor, serverName string, crt []byte) bool {
+	cert, err := m.TLSConfig().GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil || cert == nil {
+		return false
+	}
+	block, _ := pem.Decode(crt)
+	return bytes.Equal(cert.Certificate[0], block.Bytes)
+}
@@ -0,0 +1,90 @@
+package kubecerthttp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// CertInfo describes the certificate that would be served for a domain
+type CertInfo struct {
+	Secret    string // namespace/name of the secret holding the certificate
+	NotBefore time.Time
+	NotAfter  time.Time
+	Issuer    string
+	DNSNames  []string
+}
+
+// Validate lists the secrets once and loads their certificates like NewMonitor would, without watching the secrets or serving anything.
+// It returns the certificate that would be served for each domain, and an error for each secret that can't be loaded, e.g. for checks before deploying.
+// apiHost, namespace and hosts are like for NewTLSConfig. If the secrets can't be listed, the only error returned is the one from listing them.
+func Validate(apiHost, namespace string, hosts ...string) (map[string]CertInfo, []error) {
+	return ValidateContext(context.Background(), apiHost, namespace, hosts...)
+}
+
+// ValidateContext is like Validate, but listing the secrets is aborted once ctx is done, e.g. to bound how long a health check can take.
+func ValidateContext(ctx context.Context, apiHost, namespace string, hosts ...string) (map[string]CertInfo, []error) {
+	cfg := newConfig([]Option{WithHosts(hosts...), WithLogger(slog.New(slog.DiscardHandler))})
+	if err := cfg.validate(); err != nil {
+		return nil, []error{err}
+	}
+	apiHost, err := normalizeAPIHost(apiHost)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	list, err := listSecrets(ctx, cfg, apiHost, namespace)
+	if err != nil {
+		return nil, []error{fmt.Errorf("Unable to list secrets in namespace %v at %v: %w", namespace, apiHost, err)}
+	}
+
+	m := newMonitor(cfg)
+	for i := range list.Items {
+		m.handleEvent(secretEvent{Type: "ADDED", Object: list.Items[i]})
+	}
+
+	// Load the secrets that failed again to get their errors, in a stable order
+	keys := make([]string, 0, len(m.failed))
+	for key := range m.failed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		event := m.failed[key]
+		domain := m.failedDomain(&event.Object)
+		if _, err := m.loadCert(domain, key, &event.Object); err != nil {
+			errs = append(errs, fmt.Errorf("Unable to load secret %v for domain %v: %w", key, domain, err))
+		}
+	}
+
+	infos := make(map[string]CertInfo, len(m.candidates))
+	for domain, candidates := range m.candidates {
+		if len(candidates) == 0 || candidates[0].cert.Leaf == nil {
+			continue
+		}
+		leaf := candidates[0].cert.Leaf
+		infos[domain] = CertInfo{
+			Secret:    candidates[0].secret,
+			NotBefore: leaf.NotBefore,
+			NotAfter:  leaf.NotAfter,
+			Issuer:    leaf.Issuer.String(),
+			DNSNames:  leaf.DNSNames,
+		}
+	}
+	return infos, errs
+}
+
+// failedDomain returns the domain a secret that failed to load was loaded for, the first of its domains that is served
+func (m *Monitor) failedDomain(s *secret) string {
+	domains := m.secretDomains(s)
+	for _, domain := range domains {
+		if m.hostAllowed(domain) {
+			return domain
+		}
+	}
+	return domains[0]
+}
@@ -0,0 +1,592 @@
+package kubecerthttp
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// versionTracker holds the resource version a watch continues from, it can be read while the watch is running
+type versionTracker struct {
+	mutex   sync.Mutex
+	version string
+}
+
+func (t *versionTracker) get() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.version
+}
+
+func (t *versionTracker) set(version string) {
+	t.mutex.Lock()
+	t.version = version
+	t.mutex.Unlock()
+}
+
+// eventListed is the type of the event sent after the events for a list of the secrets, it isn't about a secret
+const eventListed = "LISTED"
+
+// errWatchStalled is returned when nothing was received on a watch for longer than the idle timeout
+var errWatchStalled = errors.New("Watch stalled, nothing was received within the idle timeout")
+
+// errResourceVersionExpired is returned when the resource version being watched from has been compacted by the API server
+var errResourceVersionExpired = errors.New("Resource version expired")
+
+// StatusError is returned when the API server refuses a request with an unexpected status code, or ends a watch with an error event.
+// It can be inspected using errors.As, e.g. to tell authorization problems (401 and 403) apart from temporary failures.
+type StatusError struct {
+	Code    int    // HTTP status code
+	Status  string // status line of the response, empty for error events
+	Reason  string // reason from the Status object of error events, e.g. "Expired"
+	Message string // message from the Status object of error events
+}
+
+func (e *StatusError) Error() string {
+	if e.Status != "" {
+		return "Invalid status code: " + e.Status
+	}
+	return fmt.Sprintf("Kubernetes API error %d (%v): %v", e.Code, e.Reason, e.Message)
+}
+
+// watchTimeoutGrace is how long after the watch timeout the connection is closed if the API server didn't end the watch
+const watchTimeoutGrace = 30 * time.Second
+
+// cancelOnClose cancels the context of a request once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// idleReader resets the idle timer of a watch whenever data is received
+type idleReader struct {
+	io.Reader
+	idle    *time.Timer
+	maxIdle time.Duration
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.idle.Reset(r.maxIdle)
+	}
+	return n, err
+}
+
+// stableWatchDuration is how long a watch has to run before the reconnect backoff is reset
+const stableWatchDuration = time.Minute
+
+// backoff computes exponentially growing delays between min and max
+type backoff struct {
+	min, max time.Duration
+	next     time.Duration
+}
+
+// delay returns the time to wait before the next attempt, and doubles the delay for the attempt after that
+func (b *backoff) delay() time.Duration {
+	if b.next < b.min {
+		b.next = b.min
+	}
+
+	d := b.next
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+
+	// Randomize the second half of the delay, so that many replicas don't all reconnect at the same time
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// reset makes the next delay start at min again
+func (b *backoff) reset() {
+	b.next = b.min
+}
+
+// monitorSecretEvents watches the secrets in the given namespace and streams the events on the returned channel.
+// The initial list and the first connection to the watch endpoint are made synchronously, so that unreachable hosts or unauthorized requests are reported to the caller.
+// Every watch is ended after the watch timeout and restarted from the last resource version, which detects connections that died silently.
+// Failed watches are retried with an exponential backoff, as configured through WithReconnectBackoff, watches ended cleanly are restarted after the delay set through WithWatchRestartDelay.
+// The secrets are listed before watching, and the watch starts from the resource version of the list, so it only sends changes made after it.
+// When the API server reports that the resource version has expired (410 Gone), the secrets are listed again, and the watch is restarted right away.
+// When a resync period is set, the watch is ended periodically to list all secrets, and events are generated for the differences with what was seen so far.
+// Watching stops once ctx is cancelled, at which point the events channel is closed.
+// The resource version being watched from is kept in version, which is owned by this watch.
+func monitorSecretEvents(ctx context.Context, cfg *config, apiHost, namespace string, version *versionTracker) (<-chan secretEvent, <-chan error, error) {
+	events := make(chan secretEvent)
+	errc := make(chan error, 1)
+
+	// known holds the metadata and type of the secrets sent so far, by namespace/name, for resyncs to compare with
+	known := make(map[string]secret)
+	nextResync := time.Now().Add(cfg.resyncPeriod)
+
+	connect := func() (*http.Response, error) {
+		if err := cfg.rateLimiter.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		// The API server ends the watch after the timeout, if it doesn't the connection is assumed dead and gets closed
+		reqCtx, cancel := ctx, context.CancelFunc(func() {})
+		if cfg.watchTimeout > 0 {
+			reqCtx, cancel = context.WithTimeout(ctx, cfg.watchTimeout+watchTimeoutGrace)
+		}
+		if cfg.resyncPeriod > 0 {
+			// The watch is ended for the next resync
+			var cancelResync context.CancelFunc
+			reqCtx, cancelResync = context.WithDeadline(reqCtx, nextResync)
+			cancelTimeout := cancel
+			cancel = func() {
+				cancelResync()
+				cancelTimeout()
+			}
+		}
+
+		req, err := http.NewRequestWithContext(reqCtx, "GET", watchURL(cfg, apiHost, namespace, version.get()), nil)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		resp, err := cfg.client.Do(req)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusGone && version.get() != "" {
+			resp.Body.Close()
+			cancel()
+			version.set("")
+			return nil, errResourceVersionExpired
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			cancel()
+			return nil, &StatusError{Code: resp.StatusCode, Status: resp.Status}
+		}
+
+		resp.Body = cancelOnClose{resp.Body, cancel}
+		return resp, nil
+	}
+
+	// send sends the event to the monitor, and keeps track of the secrets that exist. It returns false once ctx is cancelled.
+	send := func(event secretEvent) bool {
+		key := secretKey(&event.Object)
+		if event.Type == "DELETED" {
+			delete(known, key)
+		} else {
+			known[key] = secret{Metadata: event.Object.Metadata, Type: event.Object.Type}
+		}
+
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	watch := func(resp *http.Response) error {
+		defer resp.Body.Close()
+
+		// Closing the body is the only way to get reads to return while nothing is received, which includes reading the gzip header
+		var stalled atomic.Bool
+		var idle *time.Timer
+		if cfg.maxIdle > 0 {
+			idle = time.AfterFunc(cfg.maxIdle, func() {
+				stalled.Store(true)
+				resp.Body.Close()
+			})
+			defer idle.Stop()
+		}
+
+		body, err := responseBody(resp)
+		if stalled.Load() {
+			return errWatchStalled
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if idle != nil {
+			body = idleReader{body, idle, cfg.maxIdle}
+		}
+
+		decoder := json.NewDecoder(body)
+		for {
+			var raw watchEvent
+			err := decoder.Decode(&raw)
+			if stalled.Load() {
+				return errWatchStalled
+			}
+			if err != nil {
+				if err != io.EOF {
+					return err
+				}
+				break
+			}
+
+			// The decoder skips whitespace between events, such as blank lines sent by proxies to keep the connection alive, but empty objects have to be skipped too
+			if raw.Type == "" && (len(raw.Object) == 0 || string(raw.Object) == "null") {
+				continue
+			}
+
+			// Errors carry a Status object instead of a secret, the API server ends the watch after sending one
+			if raw.Type == "ERROR" {
+				var st status
+				if err := json.Unmarshal(raw.Object, &st); err != nil {
+					return fmt.Errorf("Unable to decode error event: %v", err)
+				}
+				if st.Code == http.StatusGone || st.Reason == "Expired" {
+					version.set("")
+					return errResourceVersionExpired
+				}
+				return &StatusError{Code: st.Code, Reason: st.Reason, Message: st.Message}
+			}
+
+			event := secretEvent{Type: raw.Type}
+			if err := json.Unmarshal(raw.Object, &event.Object); err != nil {
+				return err
+			}
+			if s, ok := event.Object.Metadata["resourceVersion"].(string); ok {
+				version.set(s)
+			}
+
+			// Bookmarks only exist to advance the resource version, so a reconnect doesn't need to go back as far
+			if event.Type == "BOOKMARK" {
+				continue
+			}
+
+			if !send(event) {
+				return nil
+			}
+		}
+		return nil
+	}
+
+	list := func() (*secretList, error) {
+		return listSecrets(ctx, cfg, apiHost, namespace)
+	}
+
+	// reconcile sends events for the differences between the listed secrets and the ones sent so far, and makes the next watch start after the list
+	reconcile := func(list *secretList) error {
+		listed := make(map[string]struct{}, len(list.Items))
+		for _, s := range list.Items {
+			key := secretKey(&s)
+			listed[key] = struct{}{}
+
+			event := secretEvent{Type: "ADDED", Object: s}
+			if prev, ok := known[key]; ok {
+				if prev.Metadata["resourceVersion"] == s.Metadata["resourceVersion"] {
+					continue
+				}
+				event.Type = "MODIFIED"
+			}
+			if !send(event) {
+				return ctx.Err()
+			}
+		}
+		for key, s := range known {
+			if _, ok := listed[key]; ok {
+				continue
+			}
+			if !send(secretEvent{Type: "DELETED", Object: s}) {
+				return ctx.Err()
+			}
+		}
+
+		// Lets the monitor know the events for the list have all been sent
+		select {
+		case events <- secretEvent{Type: eventListed}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		version.set(list.Metadata.ResourceVersion)
+		return nil
+	}
+
+	resync := func() error {
+		l, err := list()
+		if err != nil {
+			return err
+		}
+		nextResync = time.Now().Add(cfg.resyncPeriod)
+		return reconcile(l)
+	}
+
+	setState := func(state WatchState, err error) {
+		// State changes caused by stopping the monitor aren't worth reporting
+		if cfg.onConnectionState != nil && ctx.Err() == nil {
+			cfg.onConnectionState(state, err)
+		}
+	}
+
+	report := func(err error) {
+		// Errors caused by stopping the monitor aren't worth reporting
+		if ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case errc <- err:
+		case <-ctx.Done():
+		}
+	}
+
+	// A watch resuming from the resource version set through WithInitialResourceVersion skips the initial list,
+	// unless the API server no longer has that version, in which case connect clears it to list the secrets instead
+	var initial *secretList
+	var resp *http.Response
+	var err error
+	if cfg.initialResourceVersion != "" {
+		version.set(cfg.initialResourceVersion)
+		if resp, err = connect(); err == errResourceVersionExpired {
+			err = nil
+		}
+	}
+
+	// Otherwise the watch starts from the resource version of the initial list, so it only sends changes made after it
+	if resp == nil && err == nil {
+		initial, err = list()
+		if err == nil {
+			version.set(initial.Metadata.ResourceVersion)
+			resp, err = connect()
+		}
+	}
+	if err != nil {
+		if namespace == AllNamespaces {
+			return nil, nil, fmt.Errorf("Unable to watch secrets in all namespaces at %v: %w", apiHost, err)
+		}
+		return nil, nil, fmt.Errorf("Unable to watch secrets in namespace %v at %v: %w", namespace, apiHost, err)
+	}
+	setState(WatchConnected, nil)
+
+	go func() {
+		defer close(events)
+
+		if initial != nil {
+			if err := reconcile(initial); err != nil {
+				resp.Body.Close()
+				return
+			}
+		}
+
+		b := &backoff{min: cfg.backoffMin, max: cfg.backoffMax}
+		for {
+			started := time.Now()
+			err := watch(resp)
+			stable := time.Since(started) >= stableWatchDuration
+			if stable {
+				b.reset()
+			}
+			setState(WatchDisconnected, err)
+
+			// Watches ended cleanly by the API server are restarted after the restart delay, unless they ended right away, in which case something is off and backing off is safer
+			restart := err == nil && stable
+
+			// Keep trying to reconnect until the watch is established again, expired watches are restarted right away after listing the secrets again, as are watches ended for a resync
+			for {
+				setState(WatchReconnecting, err)
+				resynced := false
+				if version.get() == "" || (cfg.resyncPeriod > 0 && !time.Now().Before(nextResync)) {
+					err = resync()
+					resynced = err == nil
+				}
+
+				if err != errResourceVersionExpired && !resynced {
+					if err != nil {
+						report(err)
+					}
+
+					delay := cfg.restartDelay
+					if !restart {
+						delay = b.delay()
+					}
+					restart = false
+
+					select {
+					case <-time.After(delay):
+					case <-ctx.Done():
+						return
+					}
+				}
+
+				if resp, err = connect(); err == nil {
+					setState(WatchConnected, nil)
+					break
+				}
+			}
+		}
+	}()
+
+	return events, errc, nil
+}
+
+// listSecrets lists the secrets that are watched in namespace
+func listSecrets(ctx context.Context, cfg *config, apiHost, namespace string) (*secretList, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", listURL(cfg, apiHost, namespace), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	if err := cfg.rateLimiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := cfg.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	body, err := responseBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode secret list: %v", err)
+	}
+
+	var list secretList
+	if err := json.NewDecoder(body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("Unable to decode secret list: %v", err)
+	}
+	return &list, nil
+}
+
+// getSecret fetches a single secret, a 404 is reported as a StatusError
+func getSecret(ctx context.Context, cfg *config, apiHost, namespace, name string) (*secret, error) {
+	u, err := url.Parse(listURL(cfg, apiHost, namespace))
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/" + name
+	u.RawPath = ""
+	u.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.rateLimiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := cfg.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	var s secret
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return nil, fmt.Errorf("Unable to decode secret: %v", err)
+	}
+	return &s, nil
+}
+
+// responseBody returns the body of a response to a request that accepted gzip, decompressing it if the server compressed it.
+// Requests set Accept-Encoding themselves, so compression works regardless of the transport's DisableCompression setting.
+// Reading the gzip header blocks until the server sends data, and io.EOF is returned if the body is empty.
+func responseBody(resp *http.Response) (io.Reader, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp.Body, nil
+	}
+	return gzip.NewReader(resp.Body)
+}
+
+// listURL returns the URL listing the secrets that are watched
+func listURL(cfg *config, apiHost, namespace string) string {
+	u, err := url.Parse(watchURL(cfg, apiHost, namespace, ""))
+	if err != nil {
+		// Let the request report the invalid URL
+		return watchURL(cfg, apiHost, namespace, "")
+	}
+
+	query := u.Query()
+	for _, param := range []string{"watch", "allowWatchBookmarks", "resourceVersion", "timeoutSeconds"} {
+		query.Del(param)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// secretKey returns the namespace/name of a secret
+func secretKey(s *secret) string {
+	name, _ := s.Metadata["name"].(string)
+	namespace, _ := s.Metadata["namespace"].(string)
+	return namespace + "/" + name
+}
+
+// normalizeAPIHost adds the http scheme to an API host that has none and strips trailing slashes, an error is returned if it isn't a valid http(s) URL
+func normalizeAPIHost(apiHost string) (string, error) {
+	normalized := apiHost
+	if !strings.Contains(normalized, "://") {
+		normalized = "http://" + normalized
+	}
+	normalized = strings.TrimRight(normalized, "/")
+
+	u, err := url.Parse(normalized)
+	if err != nil {
+		return "", fmt.Errorf("Invalid API host %q: %v", apiHost, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("Invalid API host %q: scheme must be http or https", apiHost)
+	}
+	if u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("Invalid API host %q: must be a host with an optional path, such as %v", apiHost, APIHostKubectlProxy)
+	}
+	return normalized, nil
+}
+
+// watchURL returns the URL to watch the secrets in namespace from resourceVersion on
+func watchURL(cfg *config, apiHost, namespace, resourceVersion string) string {
+	var u string
+	switch {
+	case cfg.secretsURL != nil:
+		u = cfg.secretsURL(apiHost, namespace)
+		separator := "?"
+		if strings.Contains(u, "?") {
+			separator = "&"
+		}
+		u += separator + "watch=true&allowWatchBookmarks=true&resourceVersion=" + url.QueryEscape(resourceVersion)
+	case cfg.secretsPathTemplate != "":
+		u = apiHost + fmt.Sprintf(cfg.secretsPathTemplate, namespace, url.QueryEscape(resourceVersion))
+	case namespace == AllNamespaces:
+		u = fmt.Sprintf(allSecretsWatchEndpoint, apiHost, url.QueryEscape(resourceVersion))
+	default:
+		u = fmt.Sprintf(secretsWatchEndpoint, apiHost, namespace, url.QueryEscape(resourceVersion))
+	}
+
+	if cfg.labelSelector != "" {
+		u += "&labelSelector=" + url.QueryEscape(cfg.labelSelector)
+	}
+	if cfg.fieldSelector != "" {
+		u += "&fieldSelector=" + url.QueryEscape(cfg.fieldSelector)
+	}
+	if cfg.watchTimeout > 0 {
+		u += "&timeoutSeconds=" + strconv.Itoa(int(cfg.watchTimeout/time.Second))
+	}
+	return u
+}
@@ -0,0 +1,257 @@
+package kubecerthttp
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// SecretEvent is a change to a secret seen by a Watcher
+type SecretEvent struct {
+	Type        string // ADDED, MODIFIED or DELETED
+	Namespace   string
+	Name        string
+	SecretType  string // e.g. kubernetes.io/tls
+	Labels      map[string]string
+	Annotations map[string]string
+	Data        map[string][]byte
+}
+
+// Watcher streams the changes to the kubernetes secrets in one or more namespaces, without loading any certificates.
+// It is what Monitor is built on, and can be used to react to changes to secrets in other ways, e.g. to copy them elsewhere.
+type Watcher struct {
+	sources []eventSource
+	clients []*http.Client // clients used by the sources, for the lifetime of the watcher
+
+	// versions holds the resource version each namespace is watched from, every namespace keeps track of its own
+	versions map[string]*versionTracker
+	// configs holds the config each namespace is watched with, to fetch single secrets with
+	configs map[string]*config
+	apiHost string
+
+	events chan SecretEvent
+	errc   chan error
+
+	// started is set once the watcher is started, or stopped before that, it is guarded by startMutex
+	startMutex sync.Mutex
+	started    bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewWatcher returns a watcher for the secrets in the given namespace, and the ones passed to WithNamespaces and WithNamespaceSources, call Start to start watching.
+// apiHost and namespace are like for NewMonitor. Of the options, only the ones configuring how secrets are watched apply,
+// such as WithHTTPClient, WithLabelSelector, WithFieldSelector, WithReconnectBackoff and WithResyncPeriod.
+// An error is returned if the options or apiHost are invalid.
+func NewWatcher(apiHost, namespace string, opts ...Option) (*Watcher, error) {
+	cfg := newConfig(opts)
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	apiHost, err := normalizeAPIHost(apiHost)
+	if err != nil {
+		return nil, err
+	}
+	return newWatcher(cfg, apiHost, namespace), nil
+}
+
+// newWatcher sets up a watcher with a source per namespace, without starting it
+func newWatcher(cfg *config, apiHost, namespace string) *Watcher {
+	w := &Watcher{
+		events: make(chan SecretEvent),
+		errc:   make(chan error, 1),
+		done:   make(chan struct{}),
+
+		versions: make(map[string]*versionTracker),
+		configs:  make(map[string]*config),
+		apiHost:  apiHost,
+	}
+
+	w.clients = append(w.clients, cfg.client)
+
+	// Namespaces are watched once, a NamespaceSource for a namespace that is already watched replaces its config
+	var namespaces []string
+	for _, ns := range append([]string{namespace}, cfg.namespaces...) {
+		if _, ok := w.configs[ns]; !ok {
+			namespaces = append(namespaces, ns)
+			w.configs[ns] = cfg
+		}
+	}
+
+	// Namespaces with a client of their own get a copy of the config using it
+	for _, source := range cfg.namespaceSources {
+		nsCfg := *cfg
+		if source.HTTPClient != nil {
+			nsCfg.client = source.HTTPClient
+			w.clients = append(w.clients, source.HTTPClient)
+		}
+		if _, ok := w.configs[source.Namespace]; !ok {
+			namespaces = append(namespaces, source.Namespace)
+		}
+		w.configs[source.Namespace] = &nsCfg
+	}
+
+	for _, ns := range namespaces {
+		ns, nsCfg, version := ns, w.configs[ns], &versionTracker{}
+		w.versions[ns] = version
+		w.sources = append(w.sources, func(ctx context.Context) (<-chan secretEvent, <-chan error, error) {
+			return monitorSecretEvents(ctx, nsCfg, apiHost, ns, version)
+		})
+	}
+	return w
+}
+
+// Start lists the secrets and starts watching them, the current secrets are sent as ADDED events first.
+// Like NewMonitor, an error is returned if the secrets endpoint can't be reached or refuses the request, in which case nothing is watched.
+// Watching stops when Stop is called or ctx is cancelled. Start must only be called once, an error is returned otherwise, or if the watcher was stopped before.
+func (w *Watcher) Start(ctx context.Context) error {
+	w.startMutex.Lock()
+	defer w.startMutex.Unlock()
+	if w.started {
+		return errWatcherStarted
+	}
+	w.started = true
+
+	ctx, w.cancel = context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+	for _, source := range w.sources {
+		events, errc, err := source(ctx)
+		if err != nil {
+			w.cancel()
+			wg.Wait()
+			w.closeIdleConnections()
+			close(w.events)
+			close(w.done)
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.forward(ctx, events, errc)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		w.closeIdleConnections()
+		close(w.events)
+		close(w.done)
+	}()
+	return nil
+}
+
+// forward converts the events of a source and passes them and its errors on, until the source closes its events channel
+func (w *Watcher) forward(ctx context.Context, events <-chan secretEvent, errc <-chan error) {
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Type == eventListed {
+				continue
+			}
+			select {
+			case w.events <- newSecretEvent(event):
+			case <-ctx.Done():
+			}
+		case err := <-errc:
+			// Errors are only informative, so they are dropped rather than pausing the events while nobody receives them
+			select {
+			case w.errc <- err:
+			default:
+			}
+		}
+	}
+}
+
+// Events returns the channel on which the changes to the secrets are sent, it is closed once the watcher has stopped.
+// Events must be received continuously, as watching is paused while an event isn't received.
+func (w *Watcher) Events() <-chan SecretEvent {
+	return w.events
+}
+
+// Errors returns the channel on which errors while watching are sent, watching is retried after errors.
+// Receiving from it is optional, errors are dropped while nobody is receiving them. The channel is never closed.
+func (w *Watcher) Errors() <-chan error {
+	return w.errc
+}
+
+// ResourceVersions returns the resource version each namespace is currently watched from, by namespace, e.g. for debugging or to resume from through WithInitialResourceVersion after a restart.
+// AllNamespaces is used as the key when watching all namespaces. It is empty before the secrets are listed, and after the API server reported it as expired until they are listed again.
+func (w *Watcher) ResourceVersions() map[string]string {
+	versions := make(map[string]string, len(w.versions))
+	for ns, version := range w.versions {
+		versions[ns] = version.get()
+	}
+	return versions
+}
+
+// Stop halts the watcher, closing the connections to kubernetes, and waits for it to exit.
+// Stopping a watcher that was never started makes Start fail afterwards.
+func (w *Watcher) Stop() {
+	w.startMutex.Lock()
+	if !w.started {
+		w.started = true
+		w.cancel = func() {}
+		close(w.events)
+		close(w.done)
+	}
+	w.startMutex.Unlock()
+
+	w.cancel()
+	<-w.done
+}
+
+// getSecret fetches a single secret, using the config of the namespace it is watched in
+func (w *Watcher) getSecret(ctx context.Context, namespace, name string) (*secret, error) {
+	cfg, ok := w.configs[namespace]
+	if !ok {
+		cfg = w.configs[AllNamespaces]
+	}
+	return getSecret(ctx, cfg, w.apiHost, namespace, name)
+}
+
+// closeIdleConnections closes the idle connections of the clients used to watch, once watching has stopped.
+// http.DefaultClient is skipped, as its connections are shared with the rest of the process.
+func (w *Watcher) closeIdleConnections() {
+	for _, client := range w.clients {
+		if client != http.DefaultClient {
+			client.CloseIdleConnections()
+		}
+	}
+}
+
+// newSecretEvent converts an event from the API server into a SecretEvent
+func newSecretEvent(event secretEvent) SecretEvent {
+	name, _ := event.Object.Metadata["name"].(string)
+	namespace, _ := event.Object.Metadata["namespace"].(string)
+	return SecretEvent{
+		Type:        event.Type,
+		Namespace:   namespace,
+		Name:        name,
+		SecretType:  event.Object.Type,
+		Labels:      stringMap(event.Object.Metadata["labels"]),
+		Annotations: stringMap(event.Object.Metadata["annotations"]),
+		Data:        event.Object.Data,
+	}
+}
+
+// stringMap converts a map decoded from JSON into a map of strings, values that aren't strings are left out
+func stringMap(v interface{}) map[string]string {
+	values, _ := v.(map[string]interface{})
+	if values == nil {
+		return nil
+	}
+
+	m := make(map[string]string, len(values))
+	for key, value := range values {
+		if s, ok := value.(string); ok {
+			m[key] = s
+		}
+	}
+	return m
+}
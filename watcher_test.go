@@ -0,0 +1,209 @@
+package kubecerthttp_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kubecerthttp "github.com/PalmStoneGames/kube-cert-http"
+	"github.com/PalmStoneGames/kube-cert-http/kubefake"
+)
+
+func TestWatcherStopBeforeStart(t *testing.T) {
+	w, err := kubecerthttp.NewWatcher("http://127.0.0.1:1", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Stop()
+
+	if err := w.Start(context.Background()); err == nil {
+		t.Fatal("Start succeeded after Stop")
+	}
+	if _, ok := <-w.Events(); ok {
+		t.Fatal("Events isn't closed")
+	}
+}
+
+func TestWatcherStopAfterFailedStart(t *testing.T) {
+	w, err := kubecerthttp.NewWatcher("http://127.0.0.1:1", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(context.Background()); err == nil {
+		t.Fatal("Start succeeded without an API server")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop blocked after a failed Start")
+	}
+}
+
+func TestWatcherEventsWithoutReadingErrors(t *testing.T) {
+	crt, key := newCert(t, "a.example.com")
+	api := kubefake.NewServer()
+	defer api.Close()
+
+	w, err := kubecerthttp.NewWatcher(api.URL, "default", kubecerthttp.WithReconnectBackoff(10*time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	// The invalid line ends the watch with an error, which nobody receives
+	if err := api.WaitForWatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	api.SendRaw("default", []byte("{invalid"))
+	api.SendRaw("default", []byte("{invalid"))
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("a", "a.example.com", crt, key)})
+
+	select {
+	case event := <-w.Events():
+		if event.Type != "ADDED" || event.Name != "a" {
+			t.Fatalf("Unexpected event %v %v", event.Type, event.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event received after a watch error")
+	}
+}
+
+func TestWatcherIdleTimeoutCoversGzipHeader(t *testing.T) {
+	// The watch response announces gzip, but never sends the gzip header
+	api := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "" {
+			rw.Header().Set("Content-Type", "application/json")
+			io.WriteString(rw, `{"kind":"SecretList","metadata":{"resourceVersion":"1"},"items":[]}`)
+			return
+		}
+		rw.Header().Set("Content-Encoding", "gzip")
+		rw.WriteHeader(http.StatusOK)
+		rw.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer api.Close()
+
+	w, err := kubecerthttp.NewWatcher(api.URL, "default", kubecerthttp.WithWatchIdleTimeout(50*time.Millisecond), kubecerthttp.WithReconnectBackoff(10*time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	select {
+	case err := <-w.Errors():
+		if !strings.Contains(err.Error(), "stalled") {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the watch to be reported as stalled")
+	}
+}
+
+func TestAPIHostNormalization(t *testing.T) {
+	crt, key := newCert(t, "a.example.com")
+	api := kubefake.NewServer(tlsSecret("a", "a.example.com", crt, key))
+	defer api.Close()
+
+	hostPort := strings.TrimPrefix(api.URL, "http://")
+	for _, apiHost := range []string{api.URL, api.URL + "/", hostPort, hostPort + "//"} {
+		infos, errs := kubecerthttp.Validate(apiHost, "default")
+		if len(errs) != 0 || len(infos) != 1 {
+			t.Errorf("Validate(%q) returned %v, %v", apiHost, infos, errs)
+		}
+	}
+
+	for _, apiHost := range []string{"ftp://" + hostPort, "http://", "http://" + hostPort + "?a=b", "http://[::1"} {
+		if _, err := kubecerthttp.NewWatcher(apiHost, "default"); err == nil || !strings.HasPrefix(err.Error(), "Invalid API host") {
+			t.Errorf("NewWatcher(%q) returned %v, want an invalid API host error", apiHost, err)
+		}
+	}
+}
+
+func TestSecretsURLThroughProxy(t *testing.T) {
+	crtA, keyA := newCert(t, "a.example.com")
+	crtB, keyB := newCert(t, "b.example.com")
+	api := kubefake.NewServer(tlsSecret("a", "a.example.com", crtA, keyA))
+	defer api.Close()
+
+	// The proxy only serves the API under a prefix, and streams watches as they come in
+	target, err := url.Parse(api.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httputil.NewSingleHostReverseProxy(target)
+	upstream.FlushInterval = -1
+	proxy := httptest.NewServer(http.StripPrefix("/k8s", upstream))
+	defer proxy.Close()
+
+	m, err := kubecerthttp.NewMonitor(context.Background(), proxy.URL, "default", kubecerthttp.WithSecretsURL(func(apiHost, namespace string) string {
+		return apiHost + "/k8s/api/v1/namespaces/" + namespace + "/secrets"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	waitFor(t, "a.example.com to be served", func() bool { return serves(m, "a.example.com", crtA) })
+	api.Send(kubefake.Event{Type: "ADDED", Secret: tlsSecret("b", "b.example.com", crtB, keyB)})
+	waitFor(t, "b.example.com to be served", func() bool { return serves(m, "b.example.com", crtB) })
+	if err := m.Refresh("a.example.com"); err != nil {
+		t.Errorf("Refresh: %v", err)
+	}
+}
+
+// countingTransport counts the watch requests made through it
+type countingTransport struct {
+	watches atomic.Int64
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Query().Get("watch") == "true" {
+		c.watches.Add(1)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestNamespaceSourceForWatchedNamespace(t *testing.T) {
+	crt, key := newCert(t, "a.example.com")
+	api := kubefake.NewServer(tlsSecret("a", "a.example.com", crt, key))
+	defer api.Close()
+
+	var shared, own countingTransport
+	m := startMonitor(t, api,
+		kubecerthttp.WithHTTPClient(&http.Client{Transport: &shared}),
+		kubecerthttp.WithNamespaces("default"),
+		kubecerthttp.WithNamespaceSources(kubecerthttp.NamespaceSource{Namespace: "default", HTTPClient: &http.Client{Transport: &own}}),
+	)
+	waitFor(t, "a.example.com to be served", func() bool { return serves(m, "a.example.com", crt) })
+
+	// The namespace is watched once, with the client of the source
+	time.Sleep(100 * time.Millisecond)
+	if n := own.watches.Load(); n != 1 {
+		t.Errorf("Made %v watch requests with the client of the source, want 1", n)
+	}
+	if n := shared.watches.Load(); n != 0 {
+		t.Errorf("Made %v watch requests with the shared client, want 0", n)
+	}
+	if versions := m.ResourceVersions(); len(versions) != 1 {
+		t.Errorf("Watching resource versions %v, want one namespace", versions)
+	}
+}